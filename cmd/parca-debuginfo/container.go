@@ -0,0 +1,222 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+const machOFatMagic = 0xcafebabe
+
+// containerSlice is the binary of a single architecture inside a
+// multi-architecture file, i.e. a Mach-O universal binary or an APK.
+type containerSlice struct {
+	// path is the path of the containing file, and name the one the slice
+	// is reported as.
+	path string
+	name string
+	arch string
+
+	offset int64
+	size   int64
+	// macho is set for Mach-O slices, otherwise the slice is an ELF file.
+	macho bool
+}
+
+// containerSlices returns the slices of the multi-architecture file at path,
+// or none if it is not one. Native libraries of APKs are only returned if they
+// are stored uncompressed, the names of the compressed ones are returned
+// separately.
+func containerSlices(path string) ([]containerSlice, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4) //nolint:mnd
+	if _, err := io.ReadFull(f, magic); err != nil {
+		// Too short to be a container, let the caller report what is wrong.
+		return nil, nil, nil //nolint:nilerr
+	}
+
+	switch {
+	case binary.BigEndian.Uint32(magic) == machOFatMagic:
+		ff, err := macho.NewFatFile(f)
+		if errors.Is(err, macho.ErrNotFat) {
+			return nil, nil, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("open Mach-O universal binary: %w", err)
+		}
+		defer ff.Close()
+
+		slices := make([]containerSlice, 0, len(ff.Arches))
+		for _, a := range ff.Arches {
+			arch := machOArch(a.Cpu)
+			slices = append(slices, containerSlice{
+				path:   path,
+				name:   fmt.Sprintf("%s[%s]", path, arch),
+				arch:   arch,
+				offset: int64(a.Offset),
+				size:   int64(a.Size),
+				macho:  true,
+			})
+		}
+		return slices, nil, nil
+	case bytes.Equal(magic, zipMagic):
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, nil, fmt.Errorf("stat file: %w", err)
+		}
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return nil, nil, fmt.Errorf("open zip archive: %w", err)
+		}
+
+		var (
+			slices  []containerSlice
+			skipped []string
+		)
+		for _, zf := range zr.File {
+			abi, ok := nativeLibraryABI(zf.Name)
+			if !ok {
+				continue
+			}
+			// Compressed libraries would need to be inflated first.
+			if zf.Method != zip.Store {
+				skipped = append(skipped, zf.Name)
+				continue
+			}
+			offset, err := zf.DataOffset()
+			if err != nil {
+				return nil, nil, fmt.Errorf("locate %s: %w", zf.Name, err)
+			}
+			slices = append(slices, containerSlice{
+				path:   path,
+				name:   path + "!/" + zf.Name,
+				arch:   abi,
+				offset: offset,
+				size:   int64(zf.UncompressedSize64),
+			})
+		}
+		return slices, skipped, nil
+	default:
+		return nil, nil, nil
+	}
+}
+
+// nativeLibraryABI returns the ABI of an APK entry if it is a native library,
+// stored as lib/<abi>/<name>.so.
+func nativeLibraryABI(name string) (string, bool) {
+	dir, file := path.Split(name)
+	parts := strings.Split(strings.TrimSuffix(dir, "/"), "/")
+	if len(parts) != 2 || parts[0] != "lib" || parts[1] == "" || !strings.HasSuffix(file, ".so") { //nolint:mnd
+		return "", false
+	}
+	return parts[1], true
+}
+
+func (s containerSlice) reader(r io.ReaderAt) *io.SectionReader {
+	return io.NewSectionReader(r, s.offset, s.size)
+}
+
+// buildID returns the Build ID of the slice, read from the containing file r.
+// from selects the build ID of ELF slices like --build-id-from.
+func (s containerSlice) buildID(r io.ReaderAt, from string) (string, error) {
+	if s.macho {
+		f, err := macho.NewFile(s.reader(r))
+		if err != nil {
+			return "", fmt.Errorf("open Mach-O file: %w", err)
+		}
+		defer f.Close()
+		return GetMachOBuildID(f)
+	}
+
+	f, err := elf.NewFile(s.reader(r))
+	if err != nil {
+		return "", fmt.Errorf("open ELF file: %w", err)
+	}
+	defer f.Close()
+	return getELFBuildID(f, from)
+}
+
+// debuginfoType infers the type of the slice like inferDebuginfoType.
+func (s containerSlice) debuginfoType(r io.ReaderAt) (debuginfopb.DebuginfoType, error) {
+	if s.macho {
+		f, err := macho.NewFile(s.reader(r))
+		if err != nil {
+			return 0, fmt.Errorf("open Mach-O file: %w", err)
+		}
+		defer f.Close()
+		if hasMachODWARF(f) {
+			return debuginfopb.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED, nil
+		}
+		return debuginfopb.DebuginfoType_DEBUGINFO_TYPE_EXECUTABLE, nil
+	}
+
+	f, err := elf.NewFile(s.reader(r))
+	if err != nil {
+		return 0, fmt.Errorf("open ELF file: %w", err)
+	}
+	defer f.Close()
+	return elfDebuginfoType(f), nil
+}
+
+// uploadReader reads the file, or the slice of a file, to upload.
+type uploadReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *uploadReader) Close() error {
+	return r.f.Close()
+}
+
+// open opens the file to upload.
+func (u *uploadInfo) open() (*uploadReader, error) {
+	if u.slice != nil {
+		f, err := os.Open(u.slice.path)
+		if err != nil {
+			return nil, fmt.Errorf("open file: %w", err)
+		}
+		return &uploadReader{SectionReader: u.slice.reader(f), f: f}, nil
+	}
+
+	f, err := os.Open(u.path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat file: %w", err)
+	}
+	return &uploadReader{SectionReader: io.NewSectionReader(f, 0, fi.Size()), f: f}, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errSourceNotFound is returned if none of the debuginfod servers has a
+// source file.
+var errSourceNotFound = errors.New("source file not found on any debuginfod server")
+
+// debuginfodSource is a source file fetched from a debuginfod server.
+type debuginfodSource struct {
+	url     string
+	data    []byte
+	modTime time.Time
+}
+
+// debuginfodClient fetches source files from debuginfod servers, by the Build
+// ID of the debuginfo file and the absolute path they were compiled from.
+// Results are cached, including the files none of the servers has, so that
+// names referenced by multiple compile units are only requested once.
+type debuginfodClient struct {
+	urls       []string
+	httpClient *http.Client
+
+	mu    sync.Mutex
+	cache map[string]*debuginfodSource
+}
+
+func newDebuginfodClient(urls []string, httpClient *http.Client) (*debuginfodClient, error) {
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("parse debuginfod URL %q: %w", u, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("debuginfod URL %q must use http or https", u)
+		}
+	}
+	return &debuginfodClient{
+		urls:       urls,
+		httpClient: httpClient,
+		cache:      map[string]*debuginfodSource{},
+	}, nil
+}
+
+// source returns the source file at path of the Build ID from the first
+// server that has it, or errSourceNotFound.
+func (c *debuginfodClient) source(ctx context.Context, buildID, path string) (*debuginfodSource, error) {
+	if !filepath.IsAbs(path) {
+		// Servers look files up by the absolute path they were compiled
+		// from.
+		return nil, errSourceNotFound
+	}
+	key := buildID + ":" + filepath.Clean(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.cache[key]; ok {
+		if s == nil {
+			return nil, errSourceNotFound
+		}
+		return s, nil
+	}
+
+	var errs []error
+	for _, base := range c.urls {
+		s, err := c.fetch(ctx, base, buildID, path)
+		if errors.Is(err, errSourceNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.cache[key] = s
+		return s, nil
+	}
+	if err := errors.Join(errs...); err != nil {
+		// Do not cache failures, they might be temporary.
+		return nil, err
+	}
+	c.cache[key] = nil
+	return nil, errSourceNotFound
+}
+
+func (c *debuginfodClient) fetch(ctx context.Context, base, buildID, path string) (*debuginfodSource, error) {
+	u := strings.TrimSuffix(base, "/") + "/buildid/" + url.PathEscape(buildID) + "/source" + escapeSourcePath(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errSourceNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: unexpected status %s", u, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", u, err)
+	}
+
+	s := &debuginfodSource{url: u, data: data, modTime: time.Now()}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		s.modTime = t
+	}
+	return s, nil
+}
+
+// escapeSourcePath escapes every element of the absolute path, keeping the
+// separators as debuginfod expects.
+func escapeSourcePath(path string) string {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
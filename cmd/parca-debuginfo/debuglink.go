@@ -0,0 +1,191 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errNoDebugLink is returned by readDebugLink if the ELF file has no
+// .gnu_debuglink section.
+var errNoDebugLink = errors.New("no .gnu_debuglink section")
+
+// readDebugLink returns the file name and CRC32 recorded in the .gnu_debuglink
+// section of f. The section holds the NUL-terminated name, padded to a multiple
+// of four bytes, followed by the CRC32 of the linked debug file.
+func readDebugLink(f *elf.File) (string, uint32, error) {
+	s := f.Section(".gnu_debuglink")
+	if s == nil || s.Type == elf.SHT_NOBITS {
+		return "", 0, errNoDebugLink
+	}
+	data, err := s.Data()
+	if err != nil {
+		return "", 0, fmt.Errorf("read .gnu_debuglink section: %w", err)
+	}
+
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", 0, errors.New("malformed .gnu_debuglink section: unterminated file name")
+	}
+	crcOffset := alignUp(uint64(end)+1, 4) //nolint:mnd
+	if uint64(len(data)) < crcOffset+4 {   //nolint:mnd
+		return "", 0, errors.New("malformed .gnu_debuglink section: missing CRC")
+	}
+	return string(data[:end]), f.ByteOrder.Uint32(data[crcOffset:]), nil
+}
+
+// noBuildIDError explains how to upload a pre-extracted debuginfo file that
+// lost its Build ID note, pointing at the binary it was split from if known.
+func noBuildIDError(path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ErrNoBuildID
+	}
+	defer f.Close()
+
+	name, crc, err := readDebugLink(f)
+	if err != nil {
+		return fmt.Errorf("%w: the file has no Build ID note, pass the Build ID of the binary it was extracted from with --build-id", ErrNoBuildID)
+	}
+	return fmt.Errorf("%w: the file has no Build ID note, but a .gnu_debuglink to %q with CRC %08x, pass the Build ID of the binary it was extracted from with --build-id", ErrNoBuildID, name, crc)
+}
+
+// errNoDebugAltLink is returned by readDebugAltLink if the ELF file has no
+// .gnu_debugaltlink section.
+var errNoDebugAltLink = errors.New("no .gnu_debugaltlink section")
+
+// readDebugAltLink returns the file name and Build ID of the supplementary
+// DWARF file recorded in the .gnu_debugaltlink section of f, as written by
+// dwz. The section holds the NUL-terminated name followed by the Build ID.
+func readDebugAltLink(f *elf.File) (string, string, error) {
+	s := f.Section(".gnu_debugaltlink")
+	if s == nil || s.Type == elf.SHT_NOBITS {
+		return "", "", errNoDebugAltLink
+	}
+	data, err := s.Data()
+	if err != nil {
+		return "", "", fmt.Errorf("read .gnu_debugaltlink section: %w", err)
+	}
+
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", "", errors.New("malformed .gnu_debugaltlink section: unterminated file name")
+	}
+	return string(data[:end]), hex.EncodeToString(data[end+1:]), nil
+}
+
+// findDebugAltFile returns the path of the supplementary DWARF file that the
+// ELF file at path links to. The link is tried as is, relative to the
+// directory of path, and by name and Build ID in every search directory, the
+// latter laid out like /usr/lib/debug/.build-id/xx/yyyy.debug. Only a file with
+// the expected Build ID is returned.
+func findDebugAltFile(path, name, buildID string, searchDirs []string) (string, error) {
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = append(candidates, filepath.Join(filepath.Dir(path), name))
+	}
+	for _, dir := range searchDirs {
+		candidates = append(candidates,
+			filepath.Join(dir, filepath.Base(name)),
+		)
+		if len(buildID) > 2 { //nolint:mnd
+			candidates = append(candidates, filepath.Join(dir, ".build-id", buildID[:2], buildID[2:]+".debug"))
+		}
+	}
+
+	for _, candidate := range candidates {
+		f, err := elf.Open(candidate)
+		if err != nil {
+			continue
+		}
+		got, err := GetBuildID(f)
+		f.Close()
+		if err == nil && got == buildID {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("supplementary DWARF file %q with Build ID %s not found", name, buildID)
+}
+
+// findDebugLinkFile returns the path of the separate debug file that the
+// .gnu_debuglink section of the ELF file at path names, looked up like gdb
+// does: by Build ID below every debug directory, next to path, in its .debug
+// subdirectory and below every debug directory under the directory of path.
+// Only a file with the recorded CRC32, and the Build ID of path if it has one,
+// is returned.
+func findDebugLinkFile(path, name string, crc uint32, buildID string, debugDirs []string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(abs)
+
+	var candidates []string
+	if len(buildID) > 2 { //nolint:mnd
+		for _, debugDir := range debugDirs {
+			candidates = append(candidates, filepath.Join(debugDir, ".build-id", buildID[:2], buildID[2:]+".debug"))
+		}
+	}
+	candidates = append(candidates, filepath.Join(dir, name), filepath.Join(dir, ".debug", name))
+	for _, debugDir := range debugDirs {
+		candidates = append(candidates, filepath.Join(debugDir, dir, name))
+	}
+
+	for _, candidate := range candidates {
+		if candidate == abs {
+			continue
+		}
+		got, err := crc32File(candidate)
+		if err != nil || got != crc {
+			continue
+		}
+		f, err := elf.Open(candidate)
+		if err != nil {
+			continue
+		}
+		id, err := GetBuildID(f)
+		f.Close()
+		if err == nil && id != buildID {
+			continue
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("debug file %q with CRC %08x that %q links to not found, looked for %s; fetch it, e.g. from the debug info package or debuginfod server of the distribution", name, crc, path, strings.Join(candidates, ", "))
+}
+
+// crc32File returns the CRC32 of the contents of the file at path, as recorded
+// by .gnu_debuglink sections.
+func crc32File(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// dwarfData is the DWARF data of a file together with the offsets of its
+// units, to resume reading after a unit that cannot be decoded.
+type dwarfData struct {
+	*dwarf.Data
+	// units are the offsets of the first entry of every unit in
+	// .debug_info, nil if they could not be determined.
+	units []dwarf.Offset
+}
+
+// dwLangGo is the DW_AT_language of Go compile units.
+const dwLangGo = 0x16
+
+func openDWARF(f *elf.File) (*dwarfData, error) {
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, err
+	}
+	return &dwarfData{Data: d, units: dwarfUnitOffsets(f)}, nil
+}
+
+// dwarfUnitOffsets returns the offsets of the first entry of every unit in
+// the .debug_info section of f, which follows the unit header. It returns nil
+// if the section is missing or its headers cannot be parsed.
+func dwarfUnitOffsets(f *elf.File) []dwarf.Offset {
+	s := f.Section(".debug_info")
+	if s == nil {
+		return nil
+	}
+	data, err := s.Data()
+	if err != nil {
+		return nil
+	}
+
+	var offsets []dwarf.Offset
+	for off := 0; off < len(data); {
+		hdr := data[off:]
+		if len(hdr) < 4 { //nolint:mnd
+			return nil
+		}
+		// unit_length, extended to 8 bytes for 64-bit DWARF, where the
+		// offsets in the header are 8 bytes as well.
+		length, n, offSize := uint64(f.ByteOrder.Uint32(hdr)), 4, 4
+		if length == 0xffffffff {
+			if len(hdr) < 12 { //nolint:mnd
+				return nil
+			}
+			length, n, offSize = f.ByteOrder.Uint64(hdr[4:]), 12, 8
+		}
+		if len(hdr) < n+3 || length > uint64(len(hdr)-n) {
+			return nil
+		}
+
+		// version, debug_abbrev_offset and address_size.
+		size := n + 2 + offSize + 1
+		if version := f.ByteOrder.Uint16(hdr[n:]); version >= 5 { //nolint:mnd
+			// The unit_type precedes them, and some unit types are
+			// followed by an 8 bytes ID and a type offset.
+			size++
+			switch hdr[n+2] {
+			case 0x04, 0x05: // DW_UT_skeleton, DW_UT_split_compile
+				size += 8
+			case 0x02, 0x06: // DW_UT_type, DW_UT_split_type
+				size += 8 + offSize
+			}
+		}
+		offsets = append(offsets, dwarf.Offset(off+size))
+		off += n + int(length)
+	}
+	return offsets
+}
+
+// walkCompileUnits calls fn for every compile unit in d with the files
+// referenced by its line table. Compile units without a line table are passed
+// no files. Partial units, as created by dwz, are passed as well.
+//
+// If onError is set, units that cannot be decoded are passed to it with the
+// offset they failed at and skipped, and compile units whose line table cannot
+// be read are passed to fn with no files. Errors are only returned if the
+// units of d are unknown, so that reading cannot be resumed at the next one.
+func walkCompileUnits(d *dwarfData, onError func(off dwarf.Offset, err error), fn func(cu *dwarf.Entry, files []*dwarf.LineFile) error) error {
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			err = fmt.Errorf("read DWARF entry: %w", err)
+			var decodeErr dwarf.DecodeError
+			if onError == nil || d.units == nil || !errors.As(err, &decodeErr) {
+				return err
+			}
+			onError(decodeErr.Offset, err)
+			next, ok := d.nextUnit(decodeErr.Offset)
+			if !ok {
+				// The last unit failed.
+				return nil
+			}
+			r.Seek(next)
+			continue
+		}
+		if e == nil {
+			return nil
+		}
+
+		if e.Tag != dwarf.TagCompileUnit && e.Tag != dwarf.TagPartialUnit {
+			continue
+		}
+		r.SkipChildren()
+
+		var files []*dwarf.LineFile
+		lr, err := d.LineReader(e)
+		switch {
+		case err != nil && onError == nil:
+			return fmt.Errorf("get line reader: %w", err)
+		case err != nil:
+			onError(e.Offset, fmt.Errorf("get line reader: %w", err))
+		case lr != nil:
+			files = lr.Files()
+		}
+		if err := fn(e, files); err != nil {
+			return err
+		}
+	}
+}
+
+// nextUnit returns the offset of the first unit after off.
+func (d *dwarfData) nextUnit(off dwarf.Offset) (dwarf.Offset, bool) {
+	for _, u := range d.units {
+		if u > off {
+			return u, true
+		}
+	}
+	return 0, false
+}
+
+// errNoDWARF is returned for binaries debug information is to be extracted
+// from, but that have no DWARF.
+var errNoDWARF = errors.New("binary has no DWARF debug info; was it built with -g?")
+
+// hasDWARFSections reports whether f has DWARF debug or line information.
+func hasDWARFSections(f *elf.File) bool {
+	for _, name := range []string{".debug_info", ".zdebug_info", ".debug_line", ".zdebug_line"} {
+		if f.Section(name) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceFileNames returns the unique names of all files referenced by the
+// line tables of ds, in the order they are first referenced, following the
+// known names, e.g. the ones of a --sources-manifest. Units that cannot be
+// read are logged and skipped.
+func sourceFileNames(ctx context.Context, logger log.Logger, known []string, ds ...*dwarfData) ([]string, error) {
+	seen := map[string]struct{}{}
+	var names []string
+	for _, name := range known {
+		if _, ok := seen[name]; !ok {
+			names = append(names, name)
+			seen[name] = struct{}{}
+		}
+	}
+	for _, d := range ds {
+		onError := func(off dwarf.Offset, err error) {
+			level.Warn(logger).Log("msg", "skipping unreadable DWARF unit", "offset", fmt.Sprintf("%#x", off), "err", err)
+		}
+		if err := walkCompileUnits(d, onError, func(cu *dwarf.Entry, files []*dwarf.LineFile) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Not every toolchain lists the primary source file of a
+			// compile unit in its line table.
+			if name := compileUnitFileName(cu); name != "" {
+				if _, ok := seen[name]; !ok {
+					names = append(names, name)
+					seen[name] = struct{}{}
+				}
+			}
+			for _, lineFile := range files {
+				if lineFile == nil {
+					continue
+				}
+				if _, ok := seen[lineFile.Name]; !ok {
+					names = append(names, lineFile.Name)
+					seen[lineFile.Name] = struct{}{}
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// compileUnitFileName returns the DW_AT_name of a compile unit resolved
+// against its DW_AT_comp_dir, like the line reader resolves file names, or an
+// empty string if the name is not a file.
+func compileUnitFileName(cu *dwarf.Entry) string {
+	if cu.Tag != dwarf.TagCompileUnit {
+		return ""
+	}
+	// Go names compile units after their package, and names like <stdin>
+	// or <artificial> of LTO units are not files either.
+	if lang, ok := cu.Val(dwarf.AttrLanguage).(int64); ok && lang == dwLangGo {
+		return ""
+	}
+	name, _ := cu.Val(dwarf.AttrName).(string)
+	if name == "" || strings.HasPrefix(name, "<") {
+		return ""
+	}
+	if dir, ok := cu.Val(dwarf.AttrCompDir).(string); ok && !path.IsAbs(name) {
+		name = path.Join(dir, name)
+	}
+	return name
+}
+
+// dwarfVersion returns the version of the first compile unit header in the
+// .debug_info section of f.
+func dwarfVersion(f *elf.File) (uint16, error) {
+	s := f.Section(".debug_info")
+	if s == nil {
+		return 0, errors.New("no .debug_info section")
+	}
+
+	// unit_length is 4 bytes, or 12 bytes for 64-bit DWARF, followed by
+	// the 2 bytes version.
+	hdr := make([]byte, 14) //nolint:mnd
+	n, err := io.ReadFull(s.Open(), hdr)
+	if err != nil && n < 6 { //nolint:mnd
+		return 0, fmt.Errorf("read compile unit header: %w", err)
+	}
+
+	off := 4
+	if f.ByteOrder.Uint32(hdr) == 0xffffffff {
+		off = 12
+		if n < off+2 {
+			return 0, fmt.Errorf("read compile unit header: %w", io.ErrUnexpectedEOF)
+		}
+	}
+	return f.ByteOrder.Uint16(hdr[off:]), nil
+}
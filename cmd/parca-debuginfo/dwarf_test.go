@@ -0,0 +1,220 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// replaceDebugInfo writes a copy of the ELF file at path with the contents of
+// its .debug_info section replaced by the result of edit.
+func replaceDebugInfo(t *testing.T, path string, edit func(info []byte) []byte) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := newELFEditor(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(e.f.Sections, func(s *elf.Section) bool { return s.Name == ".debug_info" })
+	if i < 0 {
+		t.Fatal("no .debug_info section")
+	}
+	info, err := e.f.Sections[i].Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := e.f.Sections[i]
+	e.replace(i, edit(slices.Clone(info)), 0, 0, s.Addralign)
+
+	var out bytes.Buffer
+	if err := e.writeTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	edited := filepath.Join(t.TempDir(), "edited")
+	if err := os.WriteFile(edited, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return edited
+}
+
+// testUnit is a unit of 32-bit DWARF in .debug_info.
+type testUnit struct {
+	// start is the offset of the unit header, entry the one of the
+	// compile unit entry following it.
+	start, entry int
+	name         string
+}
+
+// readTestUnits returns the compile units of the ELF file at path, and its
+// byte order.
+func readTestUnits(t *testing.T, path string) ([]testUnit, binary.ByteOrder) {
+	t.Helper()
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := openDWARF(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Section(".debug_info").Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var units []testUnit
+	start := 0
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil {
+			return units, f.ByteOrder
+		}
+		if e.Tag != dwarf.TagCompileUnit {
+			continue
+		}
+		r.SkipChildren()
+		name, _ := e.Val(dwarf.AttrName).(string)
+		units = append(units, testUnit{start: start, entry: int(e.Offset), name: name})
+		start += 4 + int(f.ByteOrder.Uint32(info[start:]))
+	}
+}
+
+func TestWalkCompileUnitsCorruptDWARF(t *testing.T) {
+	prog := buildTestBinary(t, "a", map[string]string{
+		"a.c": "int b(int);\nint a(int x) { return b(x) + 1; }\n",
+		"b.c": "int b(int x) { return x * 2; }\n",
+	})
+	units, order := readTestUnits(t, prog)
+	if len(units) != 2 || units[0].name != "a.c" || units[1].name != "b.c" {
+		t.Fatalf("unexpected compile units %+v", units)
+	}
+
+	tests := []struct {
+		name string
+		edit func(info []byte) []byte
+		// files are the base names of the files expected to be
+		// returned, in order.
+		files []string
+		// unitErrors is the number of errors expected to be passed
+		// to onError.
+		unitErrors int
+		// noUnits is set if the unit offsets are expected to be
+		// unknown.
+		noUnits bool
+		wantErr bool
+	}{
+		{
+			name:  "intact",
+			edit:  func(info []byte) []byte { return info },
+			files: []string{"a.c", "b.c"},
+		},
+		{
+			name: "bad abbrev in first unit",
+			edit: func(info []byte) []byte {
+				// An abbreviation code the unit does not define.
+				info[units[0].entry] = 0x7f
+				return info
+			},
+			files:      []string{"b.c"},
+			unitErrors: 1,
+		},
+		{
+			name: "truncated last unit",
+			edit: func(info []byte) []byte {
+				// Keep the header and the abbreviation code of the
+				// compile unit entry, but not its attributes.
+				last := units[1]
+				end := last.entry + 1
+				order.PutUint32(info[last.start:], uint32(end-last.start-4))
+				return info[:end]
+			},
+			files:      []string{"a.c"},
+			unitErrors: 1,
+		},
+		{
+			name: "unparseable unit header",
+			edit: func(info []byte) []byte {
+				// A trailing unit header too short to hold more
+				// than its length, so that the units cannot be
+				// skipped to after the bad abbreviation.
+				info[units[0].entry] = 0x7f
+				return append(info, 0, 0, 0, 0)
+			},
+			noUnits: true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := elf.Open(replaceDebugInfo(t, prog, tt.edit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			d, err := openDWARF(f)
+			if err != nil {
+				t.Fatalf("open DWARF: %v", err)
+			}
+			if (d.units == nil) != tt.noUnits {
+				t.Fatalf("got unit offsets %v", d.units)
+			}
+
+			var (
+				files      []string
+				unitErrors int
+			)
+			err = walkCompileUnits(d, func(dwarf.Offset, error) {
+				unitErrors++
+			}, func(cu *dwarf.Entry, lineFiles []*dwarf.LineFile) error {
+				for _, lf := range lineFiles {
+					if lf != nil && !slices.Contains(files, filepath.Base(lf.Name)) {
+						files = append(files, filepath.Base(lf.Name))
+					}
+				}
+				return nil
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("walk compile units: %v", err)
+			}
+			if !slices.Equal(files, tt.files) {
+				t.Errorf("got files %v, want %v", files, tt.files)
+			}
+			if unitErrors != tt.unitErrors {
+				t.Errorf("got %d unit errors, want %d", unitErrors, tt.unitErrors)
+			}
+		})
+	}
+}
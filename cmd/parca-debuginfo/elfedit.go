@@ -0,0 +1,446 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// elfEditor rewrites the sections of an ELF file without touching its
+// segments. The contents of changed and added sections are appended to the
+// end of the file, followed by a new section header table. This only works
+// for sections that are not loaded at runtime, such as debug information,
+// which is also the only kind of sections that can be removed.
+type elfEditor struct {
+	src  io.ReaderAt
+	size int64
+	f    *elf.File
+
+	ehdr     []byte
+	sections []*editSection
+	shstrndx int
+}
+
+type editSection struct {
+	hdr elf.Section64
+	// data replaces the original contents if not nil.
+	data []byte
+	// name is set for added sections, whose name is not yet part of the
+	// section header string table.
+	name string
+	// removed is set for sections that are dropped from the output.
+	removed bool
+}
+
+func newELFEditor(src io.ReaderAt, size int64) (*elfEditor, error) {
+	f, err := elf.NewFile(src)
+	if err != nil {
+		return nil, fmt.Errorf("open ELF file: %w", err)
+	}
+
+	e := &elfEditor{src: src, size: size, f: f}
+
+	var (
+		shoff           uint64
+		shentsize       int
+		shnum, shstrndx uint16
+	)
+	switch f.Class {
+	case elf.ELFCLASS64:
+		var hdr elf.Header64
+		if err := binary.Read(io.NewSectionReader(src, 0, size), f.ByteOrder, &hdr); err != nil {
+			return nil, fmt.Errorf("read ELF header: %w", err)
+		}
+		e.ehdr = make([]byte, binary.Size(hdr))
+		shoff, shentsize, shnum, shstrndx = hdr.Shoff, binary.Size(elf.Section64{}), hdr.Shnum, hdr.Shstrndx
+	case elf.ELFCLASS32:
+		var hdr elf.Header32
+		if err := binary.Read(io.NewSectionReader(src, 0, size), f.ByteOrder, &hdr); err != nil {
+			return nil, fmt.Errorf("read ELF header: %w", err)
+		}
+		e.ehdr = make([]byte, binary.Size(hdr))
+		shoff, shentsize, shnum, shstrndx = uint64(hdr.Shoff), binary.Size(elf.Section32{}), hdr.Shnum, hdr.Shstrndx
+	default:
+		return nil, fmt.Errorf("unsupported ELF class %s", f.Class)
+	}
+	if _, err := src.ReadAt(e.ehdr, 0); err != nil {
+		return nil, fmt.Errorf("read ELF header: %w", err)
+	}
+	if shnum == 0 || shstrndx == uint16(elf.SHN_XINDEX) {
+		return nil, errors.New("ELF files with extended section numbering are not supported")
+	}
+	e.shstrndx = int(shstrndx)
+
+	r := io.NewSectionReader(src, int64(shoff), int64(shnum)*int64(shentsize)) //nolint:gosec
+	for range shnum {
+		var hdr elf.Section64
+		if f.Class == elf.ELFCLASS64 {
+			if err := binary.Read(r, f.ByteOrder, &hdr); err != nil {
+				return nil, fmt.Errorf("read section header: %w", err)
+			}
+		} else {
+			var hdr32 elf.Section32
+			if err := binary.Read(r, f.ByteOrder, &hdr32); err != nil {
+				return nil, fmt.Errorf("read section header: %w", err)
+			}
+			hdr = elf.Section64{
+				Name:      hdr32.Name,
+				Type:      hdr32.Type,
+				Flags:     uint64(hdr32.Flags),
+				Addr:      uint64(hdr32.Addr),
+				Off:       uint64(hdr32.Off),
+				Size:      uint64(hdr32.Size),
+				Link:      hdr32.Link,
+				Info:      hdr32.Info,
+				Addralign: uint64(hdr32.Addralign),
+				Entsize:   uint64(hdr32.Entsize),
+			}
+		}
+		e.sections = append(e.sections, &editSection{hdr: hdr})
+	}
+
+	return e, nil
+}
+
+// replace sets the contents of the i-th section, clearing and setting the
+// given section flags.
+func (e *elfEditor) replace(i int, data []byte, clear, set elf.SectionFlag, addralign uint64) {
+	s := e.sections[i]
+	s.data = data
+	s.hdr.Flags = s.hdr.Flags&^uint64(clear) | uint64(set)
+	s.hdr.Size = uint64(len(data))
+	s.hdr.Addralign = addralign
+}
+
+// removeSections drops the sections that are not loaded at runtime and for
+// which remove returns true, together with the relocations that apply to
+// them. The output is compacted, so that the contents of the removed sections
+// do not take up space anymore.
+func (e *elfEditor) removeSections(remove func(*elf.Section) bool) error {
+	for i, s := range e.f.Sections {
+		if i == 0 || !remove(s) {
+			continue
+		}
+		if s.Flags&elf.SHF_ALLOC != 0 || i == e.shstrndx {
+			return fmt.Errorf("cannot remove section %s", s.Name)
+		}
+		e.sections[i].removed = true
+	}
+	for i, s := range e.f.Sections {
+		if (s.Type == elf.SHT_REL || s.Type == elf.SHT_RELA) && s.Flags&elf.SHF_ALLOC == 0 &&
+			int(s.Info) < len(e.sections) && e.sections[s.Info].removed {
+			e.sections[i].removed = true
+		}
+	}
+	return e.compact()
+}
+
+// compact truncates the output after the loaded contents of the file, and
+// appends the remaining unloaded sections behind them again, so that the
+// original contents of removed and replaced sections are dropped.
+func (e *elfEditor) compact() error {
+	end, err := e.loadedEnd()
+	if err != nil {
+		return err
+	}
+	for _, s := range e.sections {
+		if s.removed || s.data != nil || s.hdr.Type == uint32(elf.SHT_NULL) || s.hdr.Type == uint32(elf.SHT_NOBITS) {
+			continue
+		}
+		if s.hdr.Off+s.hdr.Size <= end {
+			continue
+		}
+		data := make([]byte, s.hdr.Size)
+		if _, err := e.src.ReadAt(data, int64(s.hdr.Off)); err != nil { //nolint:gosec
+			return fmt.Errorf("read section: %w", err)
+		}
+		s.data = data
+	}
+	e.size = int64(end) //nolint:gosec
+	return nil
+}
+
+// loadedEnd returns the offset up to which the file contains the ELF and
+// program headers and the contents of loaded segments and sections.
+func (e *elfEditor) loadedEnd() (uint64, error) {
+	order := e.f.ByteOrder
+	var phoff, phsize uint64
+	if e.f.Class == elf.ELFCLASS64 {
+		phoff = order.Uint64(e.ehdr[0x20:])
+		phsize = uint64(order.Uint16(e.ehdr[0x36:])) * uint64(order.Uint16(e.ehdr[0x38:]))
+	} else {
+		phoff = uint64(order.Uint32(e.ehdr[0x1c:]))
+		phsize = uint64(order.Uint16(e.ehdr[0x2a:])) * uint64(order.Uint16(e.ehdr[0x2c:]))
+	}
+	end := max(uint64(len(e.ehdr)), phoff+phsize)
+	for _, p := range e.f.Progs {
+		end = max(end, p.Off+p.Filesz)
+	}
+	for _, s := range e.f.Sections {
+		if s.Flags&elf.SHF_ALLOC != 0 && s.Type != elf.SHT_NOBITS {
+			end = max(end, s.Offset+s.FileSize)
+		}
+	}
+	if end > uint64(e.size) { //nolint:gosec
+		return 0, errors.New("loaded contents exceed the file size")
+	}
+	return end, nil
+}
+
+// renumber returns the new index of every section after the removed ones are
+// dropped, or -1 for the removed ones, and rewrites the symbol tables whose
+// section indices change.
+func (e *elfEditor) renumber() ([]int, error) {
+	index := make([]int, len(e.sections))
+	n := 0
+	for i, s := range e.sections {
+		if s.removed {
+			index[i] = -1
+			continue
+		}
+		index[i] = n
+		n++
+	}
+
+	// The section index of a symbol is at offset 6 of 64-bit and at
+	// offset 14 of 32-bit symbol table entries.
+	symSize, shndxOff := 24, 6
+	if e.f.Class == elf.ELFCLASS32 {
+		symSize, shndxOff = 16, 14
+	}
+	order := e.f.ByteOrder
+	for i, s := range e.sections {
+		if s.removed {
+			continue
+		}
+		switch elf.SectionType(s.hdr.Type) {
+		case elf.SHT_SYMTAB_SHNDX, elf.SHT_GROUP:
+			return nil, fmt.Errorf("removing sections from files with a %s section is not supported", elf.SectionType(s.hdr.Type))
+		case elf.SHT_SYMTAB, elf.SHT_DYNSYM:
+		default:
+			continue
+		}
+
+		data := s.data
+		if data == nil {
+			var err error
+			data, err = e.f.Sections[i].Data()
+			if err != nil {
+				return nil, fmt.Errorf("read symbol table: %w", err)
+			}
+		}
+		changed := false
+		for off := 0; off+symSize <= len(data); off += symSize {
+			shndx := order.Uint16(data[off+shndxOff:])
+			if shndx == 0 || shndx >= uint16(elf.SHN_LORESERVE) || int(shndx) >= len(index) || index[shndx] == int(shndx) {
+				continue
+			}
+			if !changed {
+				data = bytes.Clone(data)
+				changed = true
+			}
+			// Symbols of removed sections become undefined.
+			order.PutUint16(data[off+shndxOff:], uint16(max(index[shndx], 0))) //nolint:gosec
+		}
+		if !changed {
+			continue
+		}
+		if s.hdr.Flags&uint64(elf.SHF_ALLOC) != 0 {
+			return nil, fmt.Errorf("cannot rewrite section indices of the loaded symbol table %s", e.f.Sections[i].Name)
+		}
+		s.data = data
+	}
+	return index, nil
+}
+
+// add appends a new section.
+func (e *elfEditor) add(name string, typ elf.SectionType, flags elf.SectionFlag, addralign uint64, data []byte) {
+	e.sections = append(e.sections, &editSection{
+		name: name,
+		data: data,
+		hdr: elf.Section64{
+			Type:      uint32(typ),
+			Flags:     uint64(flags),
+			Size:      uint64(len(data)),
+			Addralign: addralign,
+		},
+	})
+}
+
+// writeTo writes the edited ELF file to w.
+func (e *elfEditor) writeTo(w io.Writer) error {
+	if len(e.sections) >= int(elf.SHN_LORESERVE) {
+		return fmt.Errorf("too many sections: %d", len(e.sections))
+	}
+
+	index, err := e.renumber()
+	if err != nil {
+		return err
+	}
+	// remap returns the new index of the section at index i, or 0 if it was
+	// removed.
+	remap := func(i uint32) uint32 {
+		if i == 0 || int(i) >= len(index) {
+			return i
+		}
+		return uint32(max(index[i], 0)) //nolint:gosec
+	}
+	sections := make([]*editSection, 0, len(e.sections))
+	for _, s := range e.sections {
+		if !s.removed {
+			sections = append(sections, s)
+		}
+	}
+
+	// Names of added sections are appended to a copy of the section header
+	// string table.
+	var strtab []byte
+	for _, s := range sections {
+		if s.name == "" {
+			continue
+		}
+		if strtab == nil {
+			orig, err := e.f.Sections[e.shstrndx].Data()
+			if err != nil {
+				return fmt.Errorf("read section header string table: %w", err)
+			}
+			strtab = bytes.Clone(orig)
+		}
+		s.hdr.Name = uint32(len(strtab)) //nolint:gosec
+		strtab = append(strtab, s.name...)
+		strtab = append(strtab, 0)
+	}
+	if strtab != nil {
+		shstr := e.sections[e.shstrndx]
+		shstr.data = strtab
+		shstr.hdr.Size = uint64(len(strtab))
+	}
+
+	order := e.f.ByteOrder
+
+	// Lay out the new section contents and the section header table after
+	// the original file, so that the ELF header can be patched upfront.
+	off := uint64(e.size) //nolint:gosec
+	for _, s := range sections {
+		if s.data == nil {
+			continue
+		}
+		off = alignUp(off, s.hdr.Addralign)
+		s.hdr.Off = off
+		off += uint64(len(s.data))
+	}
+	shoff := alignUp(off, 8) //nolint:mnd
+
+	ehdr := bytes.Clone(e.ehdr)
+	shstrndx := uint16(remap(uint32(e.shstrndx))) //nolint:gosec
+	if e.f.Class == elf.ELFCLASS64 {
+		order.PutUint64(ehdr[0x28:], shoff)
+		order.PutUint16(ehdr[0x3c:], uint16(len(sections)))
+		order.PutUint16(ehdr[0x3e:], shstrndx)
+	} else {
+		if shoff > 0xffffffff {
+			return errors.New("ELF file too large for 32-bit section header offset")
+		}
+		order.PutUint32(ehdr[0x20:], uint32(shoff))
+		order.PutUint16(ehdr[0x30:], uint16(len(sections)))
+		order.PutUint16(ehdr[0x32:], shstrndx)
+	}
+
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write(ehdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(cw, io.NewSectionReader(e.src, int64(len(ehdr)), e.size-int64(len(ehdr)))); err != nil {
+		return fmt.Errorf("copy ELF file: %w", err)
+	}
+
+	for _, s := range sections {
+		if s.data == nil {
+			continue
+		}
+		if err := cw.pad(s.hdr.Off); err != nil {
+			return err
+		}
+		if _, err := cw.Write(s.data); err != nil {
+			return err
+		}
+	}
+
+	if err := cw.pad(shoff); err != nil {
+		return err
+	}
+	for _, s := range sections {
+		hdr := s.hdr
+		hdr.Link = remap(hdr.Link)
+		if hdr.Type == uint32(elf.SHT_REL) || hdr.Type == uint32(elf.SHT_RELA) || hdr.Flags&uint64(elf.SHF_INFO_LINK) != 0 {
+			hdr.Info = remap(hdr.Info)
+		}
+		var err error
+		if e.f.Class == elf.ELFCLASS64 {
+			err = binary.Write(cw, order, hdr)
+		} else {
+			err = binary.Write(cw, order, elf.Section32{
+				Name:      hdr.Name,
+				Type:      hdr.Type,
+				Flags:     uint32(hdr.Flags),
+				Addr:      uint32(hdr.Addr),
+				Off:       uint32(hdr.Off),
+				Size:      uint32(hdr.Size),
+				Link:      hdr.Link,
+				Info:      hdr.Info,
+				Addralign: uint32(hdr.Addralign),
+				Entsize:   uint32(hdr.Entsize),
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("write section header: %w", err)
+		}
+	}
+	return nil
+}
+
+func alignUp(off, align uint64) uint64 {
+	if align <= 1 {
+		return off
+	}
+	return (off + align - 1) &^ (align - 1)
+}
+
+// countingWriter tracks the offset written to, so that it can be padded to
+// absolute file offsets.
+type countingWriter struct {
+	w   io.Writer
+	off uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.off += uint64(n) //nolint:gosec
+	return n, err
+}
+
+// pad writes zeros up to off.
+func (w *countingWriter) pad(off uint64) error {
+	if off < w.off {
+		return fmt.Errorf("cannot pad to offset %d, already at %d", off, w.off)
+	}
+	_, err := w.Write(make([]byte, off-w.off))
+	return err
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"debug/elf"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestELFEditor(t *testing.T) {
+	prog := buildTestBinary(t, "a", map[string]string{
+		"a.c": "int b(int);\nint a(int x) { return b(x) + 1; }\n",
+		"b.c": "int b(int x) { return x * 2; }\n",
+	})
+	data, err := os.ReadFile(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := func(name string) bool { return name == ".comment" || name == ".debug_aranges" }
+	if orig.Section(".debug_aranges") == nil || orig.Section(".comment") == nil {
+		t.Skip("test binary misses the sections to remove")
+	}
+	note := buildIDNote([]byte{0xde, 0xad, 0xbe, 0xef}, orig.ByteOrder)
+
+	for _, tc := range []struct {
+		name  string
+		edit  func(t *testing.T, e *elfEditor)
+		check func(t *testing.T, out *elf.File, outData []byte)
+	}{
+		{
+			name: "unchanged",
+			edit: func(*testing.T, *elfEditor) {},
+			check: func(t *testing.T, out *elf.File, _ []byte) {
+				if len(out.Sections) != len(orig.Sections) {
+					t.Fatalf("got %d sections, want %d", len(out.Sections), len(orig.Sections))
+				}
+				for i, s := range out.Sections {
+					if s.Name != orig.Sections[i].Name {
+						t.Errorf("section %d is %s, want %s", i, s.Name, orig.Sections[i].Name)
+					}
+					checkSectionData(t, s, orig.Sections[i])
+				}
+			},
+		},
+		{
+			name: "replace with compressed section",
+			edit: func(t *testing.T, e *elfEditor) {
+				i := slices.IndexFunc(e.f.Sections, func(s *elf.Section) bool { return s.Name == ".debug_info" })
+				s := e.f.Sections[i]
+				info, err := s.Data()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var buf bytes.Buffer
+				buf.Write(compressionHeader(e.f, elf.COMPRESS_ZLIB, uint64(len(info)), s.Addralign))
+				zw := zlib.NewWriter(&buf)
+				zw.Write(info)
+				zw.Close()
+				e.replace(i, buf.Bytes(), 0, elf.SHF_COMPRESSED, 8)
+				if err := e.compact(); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, out *elf.File, _ []byte) {
+				s := out.Section(".debug_info")
+				if s.Flags&elf.SHF_COMPRESSED == 0 {
+					t.Errorf(".debug_info has flags %s, want SHF_COMPRESSED", s.Flags)
+				}
+				checkSectionData(t, s, orig.Section(".debug_info"))
+				for _, s := range out.Sections {
+					if s.Name != ".debug_info" {
+						checkSectionData(t, s, orig.Section(s.Name))
+					}
+				}
+				if _, err := out.DWARF(); err != nil {
+					t.Errorf("read DWARF: %v", err)
+				}
+			},
+		},
+		{
+			name: "remove sections",
+			edit: func(t *testing.T, e *elfEditor) {
+				if err := e.removeSections(func(s *elf.Section) bool { return removed(s.Name) }); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, out *elf.File, outData []byte) {
+				if want := len(orig.Sections) - 2; len(out.Sections) != want {
+					t.Fatalf("got %d sections, want %d", len(out.Sections), want)
+				}
+				for _, s := range out.Sections {
+					if removed(s.Name) {
+						t.Errorf("section %s was not removed", s.Name)
+					}
+					checkSectionData(t, s, orig.Section(s.Name))
+				}
+				if len(outData) >= len(data) {
+					t.Errorf("output has %d bytes, want less than the %d of the input", len(outData), len(data))
+				}
+
+				// The symbol table follows the removed sections, so its
+				// sh_link to the string table must have been renumbered.
+				symtab, origSymtab := out.Section(".symtab"), orig.Section(".symtab")
+				if symtab.Link == origSymtab.Link {
+					t.Fatalf(".symtab links to section %d before and after removing sections", symtab.Link)
+				}
+				if name := out.Sections[symtab.Link].Name; name != ".strtab" {
+					t.Errorf(".symtab links to %s, want .strtab", name)
+				}
+				syms, err := out.Symbols()
+				if err != nil {
+					t.Fatal(err)
+				}
+				origSyms, err := orig.Symbols()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(syms) != len(origSyms) {
+					t.Fatalf("got %d symbols, want %d", len(syms), len(origSyms))
+				}
+				for i, sym := range syms {
+					o := origSyms[i]
+					if sym.Name != o.Name || sym.Value != o.Value {
+						t.Errorf("symbol %d is %s at %#x, want %s at %#x", i, sym.Name, sym.Value, o.Name, o.Value)
+					}
+					if o.Section == elf.SHN_UNDEF || o.Section >= elf.SHN_LORESERVE {
+						if sym.Section != o.Section {
+							t.Errorf("symbol %s has section index %d, want %d", sym.Name, sym.Section, o.Section)
+						}
+						continue
+					}
+					origName := orig.Sections[o.Section].Name
+					switch {
+					case removed(origName) && sym.Section != elf.SHN_UNDEF:
+						t.Errorf("symbol %s of removed section %s has section index %d, want undefined", sym.Name, origName, sym.Section)
+					case !removed(origName) && out.Sections[sym.Section].Name != origName:
+						t.Errorf("symbol %s is in section %s, want %s", sym.Name, out.Sections[sym.Section].Name, origName)
+					}
+				}
+			},
+		},
+		{
+			name: "add note",
+			edit: func(_ *testing.T, e *elfEditor) {
+				e.add(".note.test", elf.SHT_NOTE, 0, 4, note)
+			},
+			check: func(t *testing.T, out *elf.File, _ []byte) {
+				if want := len(orig.Sections) + 1; len(out.Sections) != want {
+					t.Fatalf("got %d sections, want %d", len(out.Sections), want)
+				}
+				for i, s := range out.Sections[:len(orig.Sections)] {
+					if s.Name != orig.Sections[i].Name {
+						t.Errorf("section %d is %s, want %s", i, s.Name, orig.Sections[i].Name)
+					}
+					if s.Name != ".shstrtab" {
+						checkSectionData(t, s, orig.Sections[i])
+					}
+				}
+				s := out.Sections[len(out.Sections)-1]
+				if s.Name != ".note.test" || s.Type != elf.SHT_NOTE || s.Addralign != 4 || s.Offset%4 != 0 {
+					t.Errorf("added section is %s of type %s aligned to %d at %#x, want .note.test of type SHT_NOTE aligned to 4", s.Name, s.Type, s.Addralign, s.Offset)
+				}
+				got, err := s.Data()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, note) {
+					t.Errorf("added note is %x, want %x", got, note)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := newELFEditor(bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.edit(t, e)
+			var buf bytes.Buffer
+			if err := e.writeTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			out, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("read edited ELF file: %v", err)
+			}
+			checkLoadedUnchanged(t, orig, data, out, buf.Bytes())
+			tc.check(t, out, buf.Bytes())
+		})
+	}
+}
+
+// checkLoadedUnchanged checks that the segments and loaded sections of out
+// are at the same offsets and hold the same contents as those of orig. The
+// ELF header is not compared, as it points to the new section headers.
+func checkLoadedUnchanged(t *testing.T, orig *elf.File, origData []byte, out *elf.File, outData []byte) {
+	t.Helper()
+	if len(out.Progs) != len(orig.Progs) {
+		t.Fatalf("got %d program headers, want %d", len(out.Progs), len(orig.Progs))
+	}
+	ehsize := uint64(64)
+	if orig.Class == elf.ELFCLASS32 {
+		ehsize = 52
+	}
+	for i, p := range out.Progs {
+		o := orig.Progs[i]
+		if p.ProgHeader != o.ProgHeader {
+			t.Errorf("program header %d is %+v, want %+v", i, p.ProgHeader, o.ProgHeader)
+			continue
+		}
+		start, end := max(p.Off, ehsize), p.Off+p.Filesz
+		if end > uint64(len(outData)) || start < end && !bytes.Equal(outData[start:end], origData[start:end]) {
+			t.Errorf("contents of %s segment %d at %#x changed", p.Type, i, p.Off)
+		}
+	}
+	for _, s := range out.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		o := orig.Section(s.Name)
+		if o == nil || s.Offset != o.Offset || s.Addr != o.Addr || s.Size != o.Size {
+			t.Errorf("loaded section %s moved", s.Name)
+		}
+	}
+}
+
+// checkSectionData checks that the section s holds the same, decompressed
+// contents as want.
+func checkSectionData(t *testing.T, s, want *elf.Section) {
+	t.Helper()
+	if want == nil {
+		t.Errorf("unexpected section %s", s.Name)
+		return
+	}
+	if s.Type == elf.SHT_NOBITS {
+		return
+	}
+	got, err := s.Data()
+	if err != nil {
+		t.Fatalf("read section %s: %v", s.Name, err)
+	}
+	wantData, err := want.Data()
+	if err != nil {
+		t.Fatalf("read section %s: %v", want.Name, err)
+	}
+	if !bytes.Equal(got, wantData) {
+		t.Errorf("section %s changed", s.Name)
+	}
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/klauspost/compress/zstd"
+	"github.com/parca-dev/parca-agent/reporter/elfwriter"
+	"github.com/rzajac/flexbuf"
+)
+
+// onlyKeepDebug writes the debug information of src to dst, nullifying all
+// other sections. It keeps the same sections as elfwriter.OnlyKeepDebug and
+// additionally the .gnu_debuglink section, so that the output can still be
+// matched with the binary it was extracted from.
+//
+// It is safe to call concurrently, as the --parallelism upload workers do:
+// every call uses its own writer, and elfwriter only shares read-only
+// package state between writers.
+func onlyKeepDebug(logger log.Logger, dst io.WriteSeeker, src elfwriter.ReadAtCloser, ef extractFlags) error {
+	var opts []elfwriter.Option
+	switch ef.DWARFCompression {
+	case "zlib":
+		opts = append(opts, elfwriter.WithCompressDWARFSections())
+	case "zstd":
+		// elfwriter only compresses with zlib, so the extracted file
+		// is buffered to compress its sections afterwards.
+		buf := &flexbuf.Buffer{}
+		ef.DWARFCompression = "none"
+		if err := onlyKeepDebug(logger, buf, src, ef); err != nil {
+			return err
+		}
+		return compressDWARFZstd(dst, buf, int64(buf.Len()))
+	}
+
+	w, err := elfwriter.NewNullifyingWriter(dst, src, opts...)
+	if err != nil {
+		return fmt.Errorf("initialize nullifying writer: %w", err)
+	}
+	w.FilterPrograms(func(p *elf.Prog) bool {
+		return p.Type == elf.PT_NOTE
+	})
+	w.KeepSections(func(s *elf.Section) bool {
+		k := keepSection(s, ef)
+		level.Debug(logger).Log("msg", "selecting section", "section", s.Name, "keep", k)
+		return k
+	})
+
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("flush ELF file: %w", err)
+	}
+	return nil
+}
+
+// compressDWARFZstd writes a copy of the ELF file src of the given size to
+// dst, with its uncompressed DWARF sections compressed with zstd.
+func compressDWARFZstd(dst io.Writer, src io.ReaderAt, size int64) error {
+	e, err := newELFEditor(src, size)
+	if err != nil {
+		return err
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return fmt.Errorf("create zstd encoder: %w", err)
+	}
+	defer enc.Close()
+
+	// The compression header precedes the compressed data and is aligned
+	// like the other ELF structures of the class.
+	chdrAlign := uint64(8) //nolint:mnd
+	if e.f.Class == elf.ELFCLASS32 {
+		chdrAlign = 4
+	}
+	for i, s := range e.f.Sections {
+		if !isDWARF(s) || strings.HasPrefix(s.Name, ".zdebug_") || s.Type == elf.SHT_NOBITS || s.Flags&elf.SHF_COMPRESSED != 0 {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return fmt.Errorf("read section %s: %w", s.Name, err)
+		}
+		chdr := compressionHeader(e.f, elf.COMPRESS_ZSTD, uint64(len(data)), s.Addralign)
+		e.replace(i, enc.EncodeAll(data, chdr), 0, elf.SHF_COMPRESSED, chdrAlign)
+	}
+	if err := e.compact(); err != nil {
+		return err
+	}
+	return e.writeTo(dst)
+}
+
+// compressionHeader returns the Chdr of a compressed section of the file f,
+// with the size and alignment of the uncompressed data.
+func compressionHeader(f *elf.File, typ elf.CompressionType, size, addralign uint64) []byte {
+	order := f.ByteOrder
+	if f.Class == elf.ELFCLASS32 {
+		hdr := make([]byte, 12) //nolint:mnd
+		order.PutUint32(hdr, uint32(typ))
+		order.PutUint32(hdr[4:], uint32(size))      //nolint:gosec
+		order.PutUint32(hdr[8:], uint32(addralign)) //nolint:gosec
+		return hdr
+	}
+	// ch_type is followed by the 4 bytes of ch_reserved.
+	hdr := make([]byte, 24) //nolint:mnd
+	order.PutUint32(hdr, uint32(typ))
+	order.PutUint64(hdr[8:], size)
+	order.PutUint64(hdr[16:], addralign)
+	return hdr
+}
+
+// extractStdio extracts the debug information of the ELF file read from r and
+// writes it to w. The input is buffered in memory, as ELF files cannot be read
+// sequentially, and so is the output, to verify it before writing it.
+func extractStdio(logger log.Logger, r io.Reader, w io.Writer, ef extractFlags, buildIDFrom string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read stdin: %w", err)
+	}
+	src := bytes.NewReader(data)
+
+	f, err := elf.NewFile(src)
+	if err != nil {
+		return fmt.Errorf("open ELF file: %w", err)
+	}
+	defer f.Close()
+
+	buildID, synthesized, err := getExtractBuildID(f, buildIDFrom, ef)
+	if err != nil {
+		return fmt.Errorf("get Build ID: %w", err)
+	}
+
+	out := &flexbuf.Buffer{}
+	if err := extractDebugInfo(logger, out, nopCloserReaderAt{src}, ef, synthesized, math.MaxInt64); err != nil {
+		return fmt.Errorf("failed to extract debug information: %w", err)
+	}
+	if err := verifyExtractedBuildID(out, buildID, buildIDFrom); err != nil {
+		return err
+	}
+	out.SeekStart()
+	if _, err := io.Copy(w, out); err != nil {
+		return fmt.Errorf("write stdout: %w", err)
+	}
+	return nil
+}
+
+// nopCloserReaderAt adds a no-op Close to in-memory readers.
+type nopCloserReaderAt struct {
+	io.ReaderAt
+}
+
+func (nopCloserReaderAt) Close() error { return nil }
+
+// keepSection reports whether the contents of s are kept in the extracted
+// debug information. The defaults are those of elfwriter.OnlyKeepDebug, plus
+// .gnu_debuglink.
+func keepSection(s *elf.Section, ef extractFlags) bool {
+	keep := []func(*elf.Section) bool{
+		isDWARF,
+		isSymbolTable,
+		isGoSymbolTable,
+		isPltSymbolTable, // debug/elf applies relocations when reading DWARF.
+		isNote,
+		func(s *elf.Section) bool {
+			return s.Name == ".comment" || s.Name == ".gnu_debuglink"
+		},
+	}
+	k := slices.ContainsFunc(keep, func(pred func(*elf.Section) bool) bool {
+		return pred(s)
+	})
+	if ef.NoSymtab && isStaticSymbolTable(s) {
+		k = false
+	}
+	if ef.KeepEHFrame && isEHFrame(s) {
+		k = true
+	}
+	if k && slices.Contains(ef.ExcludeSection, s.Name) {
+		k = false
+	}
+	return k
+}
+
+// verifyExtractedBuildID checks that the extracted debug information still
+// carries the Build ID of the file it was extracted from, read as selected by
+// from.
+func verifyExtractedBuildID(extracted io.ReaderAt, buildID, from string) error {
+	ef, err := elf.NewFile(extracted)
+	if err != nil {
+		return fmt.Errorf("open extracted ELF file: %w", err)
+	}
+	defer ef.Close()
+
+	got, err := getELFBuildID(ef, from)
+	if err != nil {
+		return fmt.Errorf("get Build ID of extracted debug information: %w", err)
+	}
+	if got != buildID {
+		return fmt.Errorf("extracted debug information has Build ID %q, expected %q", got, buildID)
+	}
+	return nil
+}
+
+// splitDebug writes the debug information of the ELF file at path to
+// debugOut, and a copy of it without DWARF to strippedOut. With addDebuglink
+// the copy gets a .gnu_debuglink section pointing at debugOut instead of any
+// previous one.
+func splitDebug(logger log.Logger, path, strippedOut, debugOut string, addDebuglink bool, ef extractFlags, buildIDFrom string, tmps *tempFiles) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+	e, err := newELFEditor(f, fi.Size())
+	if err != nil {
+		return err
+	}
+	buildID, err := getELFBuildID(e.f, buildIDFrom)
+	if err != nil {
+		return fmt.Errorf("get Build ID: %w", err)
+	}
+
+	crc := crc32.NewIEEE()
+	if err := tmps.writeFile(debugOut, func(out *os.File) error {
+		if err := onlyKeepDebug(logger, out, f, ef); err != nil {
+			return err
+		}
+		if err := verifyExtractedBuildID(out, buildID, buildIDFrom); err != nil {
+			return err
+		}
+		_, err := io.Copy(crc, io.NewSectionReader(out, 0, math.MaxInt64))
+		return err
+	}); err != nil {
+		return fmt.Errorf("extract debug information: %w", err)
+	}
+
+	if err := e.removeSections(func(s *elf.Section) bool {
+		return isDWARF(s) || (addDebuglink && s.Name == ".gnu_debuglink")
+	}); err != nil {
+		return err
+	}
+	if addDebuglink {
+		e.add(".gnu_debuglink", elf.SHT_PROGBITS, 0, 4, debuglink(filepath.Base(debugOut), crc.Sum32(), e.f.ByteOrder)) //nolint:mnd
+	}
+
+	if err := tmps.writeFile(strippedOut, func(out *os.File) error {
+		if err := e.writeTo(out); err != nil {
+			return err
+		}
+		return verifyExtractedBuildID(out, buildID, buildIDFrom)
+	}); err != nil {
+		return fmt.Errorf("write stripped binary: %w", err)
+	}
+	// Keep the stripped binary executable if the original was.
+	if err := os.Chmod(strippedOut, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("set file mode: %w", err)
+	}
+
+	if tmps.sync {
+		for _, out := range []string{debugOut, strippedOut} {
+			if err := verifyOutputBuildID(out, buildID, buildIDFrom); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// debuglink returns the contents of a .gnu_debuglink section: the NUL
+// terminated file name, padded to a multiple of 4 bytes, followed by the CRC32
+// of the file.
+func debuglink(name string, crc uint32, order binary.ByteOrder) []byte {
+	n := (len(name) + 4) &^ 3 //nolint:mnd
+	data := make([]byte, n+4) //nolint:mnd
+	copy(data, name)
+	order.PutUint32(data[n:], crc)
+	return data
+}
+
+// verifyOutputBuildID reads the Build ID of the file written to path back,
+// to check that the file is readable after it was synced.
+func verifyOutputBuildID(path, buildID, from string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open written file: %w", err)
+	}
+	defer f.Close()
+
+	if err := verifyExtractedBuildID(f, buildID, from); err != nil {
+		return fmt.Errorf("verify %s: %w", path, err)
+	}
+	return nil
+}
+
+// decompressSections writes a copy of the ELF file f to output, with all
+// SHF_COMPRESSED sections decompressed. It returns the number of decompressed
+// sections.
+func decompressSections(f *os.File, output string, tmps *tempFiles) (int, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat file: %w", err)
+	}
+
+	e, err := newELFEditor(f, fi.Size())
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, s := range e.f.Sections {
+		if s.Flags&elf.SHF_COMPRESSED == 0 {
+			continue
+		}
+		// Data decompresses the section, and Addralign is already
+		// the one of the uncompressed data.
+		data, err := s.Data()
+		if err != nil {
+			return 0, fmt.Errorf("decompress section %s: %w", s.Name, err)
+		}
+		e.replace(i, data, elf.SHF_COMPRESSED, 0, s.Addralign)
+		n++
+	}
+
+	if err := tmps.writeFile(output, func(out *os.File) error {
+		return e.writeTo(out)
+	}); err != nil {
+		return 0, err
+	}
+	// Keep the copy executable if the original was.
+	if err := os.Chmod(output, fi.Mode().Perm()); err != nil {
+		return 0, fmt.Errorf("set file mode: %w", err)
+	}
+	return n, nil
+}
+
+// cleanOutputDir removes the results of a previous extract run from dir. With
+// force the whole directory is removed. Otherwise, to not wipe a directory
+// that was passed by mistake, it fails if dir contains anything else than
+// extracted files and their checksums.
+func cleanOutputDir(dir string, force bool) error {
+	if force {
+		return os.RemoveAll(dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isExtractOutput(e.Name()) {
+			return fmt.Errorf("refusing to remove %s, as it was not written by extract, pass --force to remove the whole directory", filepath.Join(dir, e.Name()))
+		}
+	}
+	for _, e := range entries {
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isExtractOutput reports whether name is one of the files extract writes.
+func isExtractOutput(name string) bool {
+	return strings.HasSuffix(name, ".debuginfo") || strings.HasSuffix(name, ".debuginfo.sha256")
+}
+
+// isDWARF, isSymbolTable, isGoSymbolTable and isPltSymbolTable are copied from
+// reporter/elfwriter/helpers.go of parca-agent
+// v0.35.3-0.20250121092521-f7e1c0878d06, the version in go.mod, which does not
+// export them. elfwriter.OnlyKeepDebug cannot drop or add sections, so they
+// have to be combined here. Compare them when updating parca-agent,
+// TestKeepSection pins the sections they keep.
+
+func isDWARF(s *elf.Section) bool {
+	return strings.HasPrefix(s.Name, ".debug_") ||
+		strings.HasPrefix(s.Name, ".zdebug_") ||
+		strings.HasPrefix(s.Name, "__debug_") // macos
+}
+
+func isSymbolTable(s *elf.Section) bool {
+	return s.Type == elf.SHT_SYMTAB || s.Type == elf.SHT_DYNSYM ||
+		s.Type == elf.SHT_STRTAB ||
+		s.Name == ".symtab" ||
+		s.Name == ".dynsym" ||
+		s.Name == ".strtab" ||
+		s.Name == ".dynstr"
+}
+
+// isStaticSymbolTable matches the static symbol table and its string table,
+// but not the dynamic ones.
+func isStaticSymbolTable(s *elf.Section) bool {
+	return s.Type == elf.SHT_SYMTAB || s.Name == ".strtab"
+}
+
+func isGoSymbolTable(s *elf.Section) bool {
+	return s.Name == ".gosymtab" ||
+		s.Name == ".gopclntab" ||
+		s.Name == ".go.buildinfo" ||
+		s.Name == ".data.rel.ro.gosymtab" ||
+		s.Name == ".data.rel.ro.gopclntab"
+}
+
+func isPltSymbolTable(s *elf.Section) bool {
+	return s.Type == elf.SHT_RELA || s.Type == elf.SHT_REL ||
+		s.Name == ".plt" ||
+		s.Name == ".plt.got" ||
+		s.Name == ".rela.plt" ||
+		s.Name == ".rela.dyn"
+}
+
+// isEHFrame matches the unwind tables used for exception handling.
+func isEHFrame(s *elf.Section) bool {
+	return s.Name == ".eh_frame" || s.Name == ".eh_frame_hdr"
+}
+
+func isNote(s *elf.Section) bool {
+	return s.Type == elf.SHT_NOTE
+}
+
+// isBuildIDNote matches the names of the notes carrying the GNU and the Go
+// build ID.
+func isBuildIDNote(name string) bool {
+	return name == ".note.gnu.build-id" || name == ".note.go.buildid"
+}
+
+// validateExtractFlags checks the flags shared by the commands that extract
+// debug information.
+func validateExtractFlags(ef extractFlags) error {
+	for _, name := range ef.ExcludeSection {
+		if isBuildIDNote(name) {
+			return fmt.Errorf("--exclude-section=%s cannot be used, stores identify debug information by its Build ID note", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/rzajac/flexbuf"
+)
+
+// buildTestBinary compiles sources, a map of file names to C code, into a
+// binary without the C runtime, so that it only has the compile units of
+// sources. The test is skipped if no C compiler is available.
+func buildTestBinary(t *testing.T, entry string, sources map[string]string) string {
+	t.Helper()
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+
+	dir := t.TempDir()
+	args := []string{"-g", "-gdwarf-4", "-O0", "-nostdlib", "-Wl,--build-id", "-Wl,-e," + entry, "-o", filepath.Join(dir, "prog")}
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(sources[name]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, name)
+	}
+
+	cmd := exec.Command(cc, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("compile test binary: %v\n%s", err, out)
+	}
+	return filepath.Join(dir, "prog")
+}
+
+// TestOnlyKeepDebugConcurrent extracts the debug information of one shared
+// file from many goroutines at once, to be run with the race detector.
+func TestOnlyKeepDebugConcurrent(t *testing.T) {
+	prog := buildTestBinary(t, "a", map[string]string{
+		"a.c": "int b(int);\nint a(int x) { return b(x) + 1; }\n",
+		"b.c": "int b(int x) { return x * 2; }\n",
+	})
+	ef, err := elf.Open(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildID, err := GetBuildID(ef)
+	ef.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	src := f
+
+	const goroutines = 16
+	variants := []extractFlags{
+		{},
+		{DWARFCompression: "zlib"},
+		{DWARFCompression: "zstd"},
+		{NoSymtab: true, KeepEHFrame: true},
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, goroutines)
+	for i := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ef := variants[i%len(variants)]
+			out := &flexbuf.Buffer{}
+			if err := onlyKeepDebug(log.NewNopLogger(), out, src, ef); err != nil {
+				errs[i] = fmt.Errorf("extract with %+v: %w", ef, err)
+				return
+			}
+			if err := verifyExtractedBuildID(out, buildID, "gnu"); err != nil {
+				errs[i] = fmt.Errorf("extract with %+v: %w", ef, err)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestValidateExtractFlags(t *testing.T) {
+	for _, tc := range []struct {
+		exclude []string
+		wantErr bool
+	}{
+		{exclude: nil},
+		{exclude: []string{".debug_pubnames", ".comment"}},
+		{exclude: []string{".debug_pubnames", ".note.gnu.build-id"}, wantErr: true},
+		{exclude: []string{".note.go.buildid"}, wantErr: true},
+		{exclude: []string{".note.gnu.property"}},
+	} {
+		err := validateExtractFlags(extractFlags{ExcludeSection: tc.exclude})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateExtractFlags(--exclude-section=%v) = %v, want error: %v", tc.exclude, err, tc.wantErr)
+		}
+	}
+}
+
+func TestKeepSection(t *testing.T) {
+	sections := []elf.SectionHeader{
+		{Name: ".interp", Type: elf.SHT_PROGBITS},
+		{Name: ".note.gnu.build-id", Type: elf.SHT_NOTE},
+		{Name: ".note.go.buildid", Type: elf.SHT_NOTE},
+		{Name: ".dynsym", Type: elf.SHT_DYNSYM},
+		{Name: ".dynstr", Type: elf.SHT_STRTAB},
+		{Name: ".rela.dyn", Type: elf.SHT_RELA},
+		{Name: ".rela.plt", Type: elf.SHT_RELA},
+		{Name: ".plt", Type: elf.SHT_PROGBITS},
+		{Name: ".plt.got", Type: elf.SHT_PROGBITS},
+		{Name: ".text", Type: elf.SHT_PROGBITS},
+		{Name: ".rodata", Type: elf.SHT_PROGBITS},
+		{Name: ".gopclntab", Type: elf.SHT_PROGBITS},
+		{Name: ".gosymtab", Type: elf.SHT_PROGBITS},
+		{Name: ".go.buildinfo", Type: elf.SHT_PROGBITS},
+		{Name: ".eh_frame_hdr", Type: elf.SHT_PROGBITS},
+		{Name: ".eh_frame", Type: elf.SHT_PROGBITS},
+		{Name: ".data", Type: elf.SHT_PROGBITS},
+		{Name: ".bss", Type: elf.SHT_NOBITS},
+		{Name: ".comment", Type: elf.SHT_PROGBITS},
+		{Name: ".gnu_debuglink", Type: elf.SHT_PROGBITS},
+		{Name: ".debug_info", Type: elf.SHT_PROGBITS},
+		{Name: ".debug_pubnames", Type: elf.SHT_PROGBITS},
+		{Name: ".zdebug_line", Type: elf.SHT_PROGBITS},
+		{Name: ".rela.debug_info", Type: elf.SHT_RELA},
+		{Name: ".symtab", Type: elf.SHT_SYMTAB},
+		{Name: ".strtab", Type: elf.SHT_STRTAB},
+		{Name: ".shstrtab", Type: elf.SHT_STRTAB},
+	}
+	defaults := []string{
+		".note.gnu.build-id", ".note.go.buildid", ".dynsym", ".dynstr", ".rela.dyn", ".rela.plt", ".plt", ".plt.got",
+		".gopclntab", ".gosymtab", ".go.buildinfo", ".comment", ".gnu_debuglink",
+		".debug_info", ".debug_pubnames", ".zdebug_line", ".rela.debug_info", ".symtab", ".strtab", ".shstrtab",
+	}
+	without := func(names ...string) []string {
+		return slices.DeleteFunc(slices.Clone(defaults), func(name string) bool { return slices.Contains(names, name) })
+	}
+
+	for _, tc := range []struct {
+		ef   extractFlags
+		want []string
+	}{
+		{ef: extractFlags{}, want: defaults},
+		{ef: extractFlags{NoSymtab: true}, want: without(".symtab", ".strtab")},
+		{ef: extractFlags{KeepEHFrame: true}, want: append(slices.Clone(defaults), ".eh_frame_hdr", ".eh_frame")},
+		{ef: extractFlags{ExcludeSection: []string{".debug_pubnames", ".text"}}, want: without(".debug_pubnames")},
+	} {
+		var got []string
+		for _, hdr := range sections {
+			if keepSection(&elf.Section{SectionHeader: hdr}, tc.ef) {
+				got = append(got, hdr.Name)
+			}
+		}
+		slices.Sort(got)
+		want := slices.Clone(tc.want)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			t.Errorf("keepSection with %+v kept %v, want %v", tc.ef, got, want)
+		}
+	}
+}
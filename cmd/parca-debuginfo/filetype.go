@@ -0,0 +1,114 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+)
+
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	tarMagic  = []byte("ustar")
+)
+
+const tarMagicOffset = 257
+
+// inferDebuginfoType returns the type of debug information to upload the file
+// at path as, for --type=auto. ELF files with DWARF are uploaded as debuginfo,
+// other ELF and PE files as executable, and tar or zstd archives as sources.
+func inferDebuginfoType(path string) (debuginfopb.DebuginfoType, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, tarMagicOffset+len(tarMagic))
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, fmt.Errorf("read file header: %w", err)
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, zstdMagic),
+		len(header) == tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], tarMagic):
+		return debuginfopb.DebuginfoType_DEBUGINFO_TYPE_SOURCES, nil
+	case bytes.HasPrefix(header, []byte(elf.ELFMAG)):
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			return 0, fmt.Errorf("open ELF file: %w", err)
+		}
+		defer ef.Close()
+
+		return elfDebuginfoType(ef), nil
+	case bytes.HasPrefix(header, []byte("MZ")):
+		return debuginfopb.DebuginfoType_DEBUGINFO_TYPE_EXECUTABLE, nil
+	default:
+		return 0, errors.New("unsupported file format, expected ELF, PE or a source archive")
+	}
+}
+
+// validateSourceArchive checks that the file at path looks like a zstd
+// compressed tar archive, as stores expect for sources: it must start with the
+// zstd magic and the first tar header must be readable.
+func validateSourceArchive(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, zstdMagic) {
+		return errors.New("not a zstd compressed file")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek to start: %w", err)
+	}
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	if _, err := tar.NewReader(zr).Next(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("tar archive is empty")
+		}
+		return fmt.Errorf("read first tar header: %w", err)
+	}
+	return nil
+}
+
+// elfDebuginfoType returns debuginfo for ELF files with DWARF and executable
+// otherwise.
+func elfDebuginfoType(ef *elf.File) debuginfopb.DebuginfoType {
+	if slices.ContainsFunc(ef.Sections, isDWARF) {
+		return debuginfopb.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED
+	}
+	return debuginfopb.DebuginfoType_DEBUGINFO_TYPE_EXECUTABLE
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// runPostExtractHook writes the extracted debug information to a temporary
+// file and runs the --post-extract-hook command with its path appended as the
+// last argument. If replace is set, the hook's stdout is returned as the new
+// payload, buffered like the extracted data, otherwise nil is returned and the
+// extracted data is uploaded as is. The hook finds the path of the file the
+// data was extracted from in PARCA_DEBUGINFO_SOURCE_PATH.
+func runPostExtractHook(ctx context.Context, hook string, replace bool, spillThreshold int64, upload *uploadInfo, extracted io.ReaderAt, size int64) (*spillBuffer, error) {
+	tmp, err := os.CreateTemp("", "parca-debuginfo-*.debuginfo")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, io.NewSectionReader(extracted, 0, size)); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("write temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("write temporary file: %w", err)
+	}
+
+	// The path is passed as a positional parameter rather than interpolated,
+	// so that it is never interpreted by the shell.
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook+` "$1"`, "sh", tmp.Name())
+	cmd.Env = append(os.Environ(),
+		"PARCA_DEBUGINFO_SOURCE_PATH="+upload.path,
+		"PARCA_DEBUGINFO_BUILD_ID="+upload.buildID,
+	)
+	cmd.Stderr = os.Stderr
+
+	if !replace {
+		cmd.Stdout = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("post-extract hook failed for %q: %w", upload.path, err)
+		}
+		return nil, nil //nolint:nilnil
+	}
+
+	out := newSpillBuffer(spillThreshold)
+	cmd.Stdout = out
+	if err := cmd.Run(); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("post-extract hook failed for %q: %w", upload.path, err)
+	}
+	// An empty payload is most likely a hook that did not write its result
+	// to stdout, and would be rejected by the stores anyway.
+	n, err := out.Size()
+	if err == nil && n == 0 {
+		err = fmt.Errorf("post-extract hook wrote nothing to stdout for %q, but its output replaces the extracted debug information", upload.path)
+	}
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestRunPostExtractHook(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell available")
+	}
+	extracted := []byte("extracted debug information")
+	upload := &uploadInfo{path: "/usr/bin/prog", buildID: "0123456789abcdef"}
+
+	for _, tc := range []struct {
+		name    string
+		hook    string
+		replace bool
+		// want is the replaced payload, nil if the extracted data is kept.
+		want    []byte
+		wantErr bool
+	}{
+		{name: "keep", hook: `test "$PARCA_DEBUGINFO_BUILD_ID" = 0123456789abcdef && grep -q 'extracted debug information'`},
+		{name: "abort", hook: "exit 3", wantErr: true},
+		{name: "abort replace", hook: "echo partial; exit 3", replace: true, wantErr: true},
+		{
+			name:    "replace",
+			hook:    `printf '%s %s ' "$PARCA_DEBUGINFO_SOURCE_PATH" "$PARCA_DEBUGINFO_BUILD_ID"; cat`,
+			replace: true,
+			want:    []byte("/usr/bin/prog 0123456789abcdef extracted debug information"),
+		},
+		{name: "replace with empty output", hook: "test -s", replace: true, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("TMPDIR", dir)
+
+			out, err := runPostExtractHook(context.Background(), tc.hook, tc.replace, defaultSpillThreshold, upload, bytes.NewReader(extracted), int64(len(extracted)))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("runPostExtractHook() error = %v, want error: %v", err, tc.wantErr)
+			}
+			switch {
+			case out == nil && tc.want != nil:
+				t.Errorf("runPostExtractHook() returned no payload, want %q", tc.want)
+			case out != nil && tc.want == nil:
+				t.Errorf("runPostExtractHook() returned a payload, want none")
+			case out != nil:
+				defer out.Close()
+				if _, err := out.Seek(0, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tc.want) {
+					t.Errorf("runPostExtractHook() returned %q, want %q", got, tc.want)
+				}
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("temporary file %s is left after the hook ran", entries[0].Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ignoreFileName is the name of the files that exclude paths of their
+// directory and its subdirectories from directory walks, in gitignore syntax.
+const ignoreFileName = ".parca-debuginfo-ignore"
+
+// ignoreRule is a pattern of an ignore file.
+type ignoreRule struct {
+	// base is the slash-separated directory of the ignore file relative to
+	// the walked directory, empty for the walked directory itself.
+	base string
+	// pattern is matched against the path relative to base like
+	// matchGlob. Patterns without a slash match at any depth, so they are
+	// prefixed with **.
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules are the rules of all ignore files of a walk, in the order they
+// were read. Like for gitignore the last matching rule decides, so that the
+// rules of deeper ignore files, which are read later, take precedence.
+type ignoreRules []ignoreRule
+
+// readIgnoreFile reads the rules of the ignore file at path, which lies in the
+// directory base. A missing file has no rules.
+func readIgnoreFile(path, base string) (ignoreRules, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open ignore file: %w", err)
+	}
+	defer f.Close()
+
+	var rules ignoreRules
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// A slash anywhere but at the end anchors the pattern to the
+		// directory of the ignore file.
+		if strings.Contains(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else {
+			line = "**/" + line
+		}
+		if err := validateGlob(line); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q in %s: %w", sc.Text(), path, err)
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read ignore file %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// ignored reports whether the slash-separated path rel, relative to the walked
+// directory, is excluded by the rules.
+func (rules ignoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		name := rel
+		if r.base != "" {
+			var ok bool
+			if name, ok = strings.CutPrefix(rel, r.base+"/"); !ok {
+				continue
+			}
+		}
+		if matchGlob(r.pattern, name) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+type debuginfoSummary struct {
+	Path            string `json:"path"`
+	BuildID         string `json:"build_id"`
+	Type            string `json:"type"`
+	Machine         string `json:"machine"`
+	Arch            string `json:"arch"`
+	Class           string `json:"class"`
+	HasDebugInfo    bool   `json:"has_debug_info"`
+	HasDebugLine    bool   `json:"has_debug_line"`
+	DWARFVersion    uint16 `json:"dwarf_version,omitempty"`
+	CompileUnits    int    `json:"compile_units"`
+	SourceFiles     int    `json:"source_files"`
+	UnreadableUnits int    `json:"unreadable_units,omitempty"`
+}
+
+// getDebuginfoSummary summarizes the ELF file at path and the DWARF debug
+// information it contains, if any.
+func getDebuginfoSummary(path string) (*debuginfoSummary, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open ELF file: %w", err)
+	}
+	defer f.Close()
+
+	buildID, err := GetBuildID(f)
+	if err != nil && !errors.Is(err, ErrNoBuildID) {
+		return nil, fmt.Errorf("get Build ID: %w", err)
+	}
+
+	info := &debuginfoSummary{
+		Path:         path,
+		BuildID:      buildID,
+		Type:         f.Type.String(),
+		Machine:      f.Machine.String(),
+		Arch:         elfArch(f),
+		Class:        f.Class.String(),
+		HasDebugInfo: f.Section(".debug_info") != nil || f.Section(".zdebug_info") != nil,
+		HasDebugLine: f.Section(".debug_line") != nil || f.Section(".zdebug_line") != nil,
+	}
+	if !info.HasDebugInfo {
+		return info, nil
+	}
+
+	if f.Section(".debug_info") != nil {
+		v, err := dwarfVersion(f)
+		if err != nil {
+			return nil, fmt.Errorf("get DWARF version: %w", err)
+		}
+		info.DWARFVersion = v
+	}
+
+	d, err := openDWARF(f)
+	if err != nil {
+		return nil, fmt.Errorf("get dwarf data: %w", err)
+	}
+
+	seen := map[string]struct{}{}
+	onError := func(dwarf.Offset, error) {
+		info.UnreadableUnits++
+	}
+	if err := walkCompileUnits(d, onError, func(cu *dwarf.Entry, files []*dwarf.LineFile) error {
+		if cu.Tag == dwarf.TagCompileUnit {
+			info.CompileUnits++
+		}
+		for _, lineFile := range files {
+			if lineFile != nil {
+				seen[lineFile.Name] = struct{}{}
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	info.SourceFiles = len(seen)
+
+	return info, nil
+}
+
+func (i *debuginfoSummary) print(w io.Writer) error {
+	dwarfVersion := "unknown"
+	if i.DWARFVersion != 0 {
+		dwarfVersion = fmt.Sprint(i.DWARFVersion)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "Path:\t%s\n", i.Path)
+	fmt.Fprintf(tw, "Build ID:\t%s\n", i.BuildID)
+	fmt.Fprintf(tw, "Type:\t%s\n", i.Type)
+	fmt.Fprintf(tw, "Machine:\t%s\n", i.Machine)
+	fmt.Fprintf(tw, "Architecture:\t%s\n", i.Arch)
+	fmt.Fprintf(tw, "Class:\t%s\n", i.Class)
+	fmt.Fprintf(tw, "Has .debug_info:\t%t\n", i.HasDebugInfo)
+	fmt.Fprintf(tw, "Has .debug_line:\t%t\n", i.HasDebugLine)
+	if i.HasDebugInfo {
+		fmt.Fprintf(tw, "DWARF version:\t%s\n", dwarfVersion)
+		fmt.Fprintf(tw, "Compile units:\t%d\n", i.CompileUnits)
+		fmt.Fprintf(tw, "Source files:\t%d\n", i.SourceFiles)
+		if i.UnreadableUnits > 0 {
+			fmt.Fprintf(tw, "Unreadable units:\t%d\n", i.UnreadableUnits)
+		}
+	}
+	return tw.Flush()
+}
+
+// elfArch returns the conventional name of the architecture of an ELF file,
+// as reported by uname -m.
+func elfArch(f *elf.File) string {
+	is64 := f.Class == elf.ELFCLASS64
+	switch f.Machine {
+	case elf.EM_386:
+		return "i386"
+	case elf.EM_X86_64:
+		return "x86_64"
+	case elf.EM_ARM:
+		return "arm"
+	case elf.EM_AARCH64:
+		return "aarch64"
+	case elf.EM_RISCV:
+		if is64 {
+			return "riscv64"
+		}
+		return "riscv32"
+	case elf.EM_PPC:
+		return "ppc"
+	case elf.EM_PPC64:
+		if f.Data == elf.ELFDATA2LSB {
+			return "ppc64le"
+		}
+		return "ppc64"
+	case elf.EM_S390:
+		if is64 {
+			return "s390x"
+		}
+		return "s390"
+	case elf.EM_MIPS:
+		if is64 {
+			return "mips64"
+		}
+		return "mips"
+	case elf.EM_LOONGARCH:
+		return "loongarch64"
+	default:
+		return strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_"))
+	}
+}
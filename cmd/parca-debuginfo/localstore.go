@@ -0,0 +1,216 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	parcadebuginfo "github.com/parca-dev/parca/pkg/debuginfo"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// localStorePrefix is the scheme of store addresses that upload to a local
+// directory instead of a Parca server, e.g. for testing.
+const localStorePrefix = "file://"
+
+// localStoreDir returns the directory of a local store address, and whether
+// address is one.
+func localStoreDir(address string) (string, bool) {
+	dir, ok := strings.CutPrefix(address, localStorePrefix)
+	return dir, ok
+}
+
+// localStore implements the debuginfo service on a local directory. It
+// simulates the upload protocol of a store, writing every upload to
+// <dir>/<buildid>/<type> once it is marked as finished.
+type localStore struct {
+	dir string
+}
+
+var _ debuginfopb.DebuginfoServiceClient = &localStore{}
+
+func newLocalStore(dir string) (*localStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("missing directory in local store address %q", localStorePrefix)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:mnd
+		return nil, fmt.Errorf("create local store directory: %w", err)
+	}
+	return &localStore{dir: dir}, nil
+}
+
+// path returns the path an upload of buildID with typ is stored at.
+func (s *localStore) path(buildID string, typ debuginfopb.DebuginfoType) (string, error) {
+	if buildID == "" || buildID != filepath.Base(buildID) || strings.HasPrefix(buildID, ".") {
+		return "", status.Errorf(codes.InvalidArgument, "invalid Build ID %q", buildID)
+	}
+	return filepath.Join(s.dir, buildID, debuginfoTypeName(typ)), nil
+}
+
+// pendingPath returns the path an upload is written to until it is marked as
+// finished.
+func (s *localStore) pendingPath(buildID, uploadID string, typ debuginfopb.DebuginfoType) (string, error) {
+	p, err := s.path(buildID, typ)
+	if err != nil {
+		return "", err
+	}
+	if uploadID == "" || uploadID != filepath.Base(uploadID) {
+		return "", status.Errorf(codes.InvalidArgument, "invalid upload ID %q", uploadID)
+	}
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+"."+uploadID), nil
+}
+
+func (s *localStore) exists(buildID string, typ debuginfopb.DebuginfoType) (bool, error) {
+	p, err := s.path(buildID, typ)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, status.Error(codes.Internal, err.Error())
+	}
+	return true, nil
+}
+
+func (s *localStore) ShouldInitiateUpload(_ context.Context, in *debuginfopb.ShouldInitiateUploadRequest, _ ...grpc.CallOption) (*debuginfopb.ShouldInitiateUploadResponse, error) {
+	exists, err := s.exists(in.GetBuildId(), in.GetType())
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !exists:
+		return &debuginfopb.ShouldInitiateUploadResponse{ShouldInitiateUpload: true, Reason: parcadebuginfo.ReasonFirstTimeSeen}, nil
+	case in.GetForce():
+		return &debuginfopb.ShouldInitiateUploadResponse{ShouldInitiateUpload: true, Reason: parcadebuginfo.ReasonDebuginfoAlreadyExistsButForced}, nil
+	default:
+		return &debuginfopb.ShouldInitiateUploadResponse{ShouldInitiateUpload: false, Reason: parcadebuginfo.ReasonDebuginfoAlreadyExists}, nil
+	}
+}
+
+func (s *localStore) InitiateUpload(_ context.Context, in *debuginfopb.InitiateUploadRequest, _ ...grpc.CallOption) (*debuginfopb.InitiateUploadResponse, error) {
+	exists, err := s.exists(in.GetBuildId(), in.GetType())
+	if err != nil {
+		return nil, err
+	}
+	if exists && !in.GetForce() {
+		return nil, status.Error(codes.AlreadyExists, parcadebuginfo.ReasonDebuginfoAlreadyExists)
+	}
+
+	id := make([]byte, 16) //nolint:mnd
+	if _, err := rand.Read(id); err != nil {
+		return nil, status.Errorf(codes.Internal, "generate upload ID: %v", err)
+	}
+	return &debuginfopb.InitiateUploadResponse{
+		UploadInstructions: &debuginfopb.UploadInstructions{
+			BuildId:        in.GetBuildId(),
+			UploadId:       hex.EncodeToString(id),
+			UploadStrategy: debuginfopb.UploadInstructions_UPLOAD_STRATEGY_GRPC,
+			Type:           in.GetType(),
+		},
+	}, nil
+}
+
+func (s *localStore) Upload(ctx context.Context, _ ...grpc.CallOption) (debuginfopb.DebuginfoService_UploadClient, error) {
+	return &localUploadStream{ctx: ctx, store: s}, nil
+}
+
+func (s *localStore) MarkUploadFinished(_ context.Context, in *debuginfopb.MarkUploadFinishedRequest, _ ...grpc.CallOption) (*debuginfopb.MarkUploadFinishedResponse, error) {
+	pending, err := s.pendingPath(in.GetBuildId(), in.GetUploadId(), in.GetType())
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.path(in.GetBuildId(), in.GetType())
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(pending, p); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, status.Errorf(codes.NotFound, "no upload %q of Build ID %q", in.GetUploadId(), in.GetBuildId())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &debuginfopb.MarkUploadFinishedResponse{}, nil
+}
+
+// localUploadStream writes the chunks of an upload to the pending file of
+// the upload given by the first message.
+type localUploadStream struct {
+	// The embedded interface is nil, only the methods used by
+	// parcadebuginfo.GrpcUploadClient are implemented.
+	grpc.ClientStream
+
+	ctx   context.Context //nolint:containedctx
+	store *localStore
+	f     *os.File
+	size  uint64
+}
+
+func (u *localUploadStream) Send(req *debuginfopb.UploadRequest) error {
+	if err := u.ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+
+	if info := req.GetInfo(); info != nil {
+		if u.f != nil {
+			return status.Error(codes.InvalidArgument, "upload info sent twice")
+		}
+		p, err := u.store.pendingPath(info.GetBuildId(), info.GetUploadId(), info.GetType())
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil { //nolint:mnd
+			return status.Error(codes.Internal, err.Error())
+		}
+		f, err := os.Create(p)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		u.f = f
+		return nil
+	}
+
+	if u.f == nil {
+		return status.Error(codes.InvalidArgument, "upload info must be sent first")
+	}
+	n, err := u.f.Write(req.GetChunkData())
+	u.size += uint64(n) //nolint:gosec
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+func (u *localUploadStream) CloseAndRecv() (*debuginfopb.UploadResponse, error) {
+	if u.f == nil {
+		return nil, status.Error(codes.InvalidArgument, "upload info must be sent first")
+	}
+	if err := u.f.Close(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &debuginfopb.UploadResponse{Size: u.size}, nil
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"debug/macho"
+	"encoding/hex"
+	"strings"
+)
+
+const loadCmdUUID macho.LoadCmd = 0x1b
+
+// GetMachOBuildID extracts the build ID from the provided Mach-O file, which is
+// the UUID of its LC_UUID load command. If there is no such load command an
+// ErrNoBuildID is returned.
+func GetMachOBuildID(f *macho.File) (string, error) {
+	for _, l := range f.Loads {
+		raw := l.Raw()
+		// cmd, cmdsize and the 16 bytes UUID.
+		if len(raw) < 24 || macho.LoadCmd(f.ByteOrder.Uint32(raw[0:4])) != loadCmdUUID { //nolint:mnd
+			continue
+		}
+		return hex.EncodeToString(raw[8:24]), nil
+	}
+	return "", ErrNoBuildID
+}
+
+// hasMachODWARF reports whether the Mach-O file contains DWARF, as binaries
+// and dSYM bundles do in their __DWARF segment.
+func hasMachODWARF(f *macho.File) bool {
+	for _, s := range f.Sections {
+		if s.Seg == "__DWARF" || strings.HasPrefix(s.Name, "__debug_") {
+			return true
+		}
+	}
+	return false
+}
+
+// machOArch returns the conventional name of a Mach-O CPU type, as used by
+// lipo and the Apple toolchain.
+func machOArch(cpu macho.Cpu) string {
+	switch cpu {
+	case macho.Cpu386:
+		return "i386"
+	case macho.CpuAmd64:
+		return "x86_64"
+	case macho.CpuArm:
+		return "arm"
+	case macho.CpuArm64:
+		return "arm64"
+	case macho.CpuPpc:
+		return "ppc"
+	case macho.CpuPpc64:
+		return "ppc64"
+	default:
+		return strings.ToLower(strings.TrimPrefix(cpu.String(), "Cpu"))
+	}
+}
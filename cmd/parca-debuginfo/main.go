@@ -15,246 +15,680 @@
 package main
 
 import (
-	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
-	"debug/dwarf"
 	"debug/elf"
+	"debug/pe"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/alecthomas/kong"
+	kongyaml "github.com/alecthomas/kong-yaml"
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
-	"github.com/klauspost/compress/zstd"
 	grun "github.com/oklog/run"
-	"github.com/parca-dev/parca-agent/reporter/elfwriter"
 	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
 	parcadebuginfo "github.com/parca-dev/parca/pkg/debuginfo"
 	"github.com/parca-dev/parca/pkg/hash"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rzajac/flexbuf"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/encoding/gzip" // Register the gzip compressor for --grpc-compression.
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
+// shouldInitiateBackoff is the delay before the first retry of asking a store
+// whether it wants a file, doubled for every further retry.
+const shouldInitiateBackoff = 200 * time.Millisecond
+
 const (
+	LogLevelError = "error"
+	LogLevelWarn  = "warn"
+	LogLevelInfo  = "info"
 	LogLevelDebug = "debug"
 )
 
+// infof prints an informational message to stdout, unless --quiet is set or
+// stdout is used for JSON output.
+func infof(flags flags, format string, a ...any) {
+	if flags.Quiet || flags.Upload.Output == "json" {
+		return
+	}
+	fmt.Fprintf(os.Stdout, format+"\n", a...)
+}
+
+// verbosef prints a progress message to stdout, if --verbose is set.
+func verbosef(flags flags, format string, a ...any) {
+	if !flags.Verbose {
+		return
+	}
+	fmt.Fprintf(os.Stdout, format+"\n", a...)
+}
+
+// formatSize formats a size in bytes for printing, human-readable like
+// 14.2 MiB unless --bytes is set.
+func formatSize(flags flags, n int64) string {
+	if flags.Bytes {
+		return strconv.FormatInt(n, 10)
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n)
+	exp := 0
+	for ; v >= unit*unit && exp < 5; exp++ {
+		v /= unit
+	}
+	return fmt.Sprintf("%.1f %ciB", v/unit, "KMGTPE"[exp])
+}
+
+// newLogger returns a logger writing to w in the configured format, filtered
+// by the configured log level.
+func newLogger(flags flags, w io.Writer) log.Logger {
+	var logger log.Logger
+	switch flags.LogFormat {
+	case "json":
+		logger = log.NewJSONLogger(log.NewSyncWriter(w))
+	default:
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(w))
+	}
+
+	var lvl level.Option
+	switch flags.LogLevel {
+	case LogLevelError:
+		lvl = level.AllowError()
+	case LogLevelWarn:
+		lvl = level.AllowWarn()
+	case LogLevelDebug:
+		lvl = level.AllowDebug()
+	default:
+		lvl = level.AllowInfo()
+	}
+
+	logger = level.NewFilter(logger, lvl)
+	return log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+}
+
+// openLogFile opens the --log-file for appending, creating it and its parent
+// directories if needed.
+func openLogFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil { //nolint:mnd
+		return nil, fmt.Errorf("create log file directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644) //nolint:mnd
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+	return f, nil
+}
+
+// storeFlags configure how to connect to the stores to upload to.
+type storeFlags struct {
+	StoreAddress       []string      `kong:"help='gRPC address to sends symbols to. Can be repeated to upload to multiple stores. With file:///DIR uploads are written to DIR/<buildid>/<type> instead, e.g. for testing without a Parca server.',env='PARCA_DEBUGINFO_STORE_ADDRESS'"`
+	BearerToken        []string      `kong:"help='Bearer token to authenticate with store. Can be repeated to use a different token per store, in the order of --store-address.',env='PARCA_DEBUGINFO_BEARER_TOKEN'"`
+	BearerTokenFile    []string      `kong:"help='File to read bearer token from to authenticate with store. Can be repeated to use a different file per store, in the order of --store-address.'"`
+	BearerTokenRefresh time.Duration `kong:"help='Re-read --bearer-token-file before a request once this long passed since it was last read, to pick up rotated tokens. The file is only read once if zero.',default='0s'"`
+	Insecure           bool          `kong:"help='Send gRPC requests via plaintext instead of TLS.',env='PARCA_DEBUGINFO_INSECURE'"`
+	InsecureSkipVerify bool          `kong:"help='Skip TLS certificate verification, both for gRPC and for uploads to signed URLs.',env='PARCA_DEBUGINFO_INSECURE_SKIP_VERIFY'"`
+	UserAgent          string        `kong:"help='User-Agent to identify with to the stores, both via gRPC and to signed URLs. Defaults to parca-debuginfo/<version>.',placeholder='USER-AGENT'"`
+	TLSServerName      string        `kong:"name='tls-server-name',help='Name to verify the TLS certificate of the stores against and to send as SNI, instead of the host of --store-address, e.g. when connecting through a proxy.',placeholder='NAME'"`
+
+	GrpcMaxCallSendSize  int               `kong:"help='Maximum size in bytes of a gRPC message sent to the store. Defaults to 64MiB, the limit of the Parca server.',default='67108864'"`
+	GrpcMaxCallRecvSize  int               `kong:"help='Maximum size in bytes of a gRPC message received from the store. Defaults to 64MiB, the limit of the Parca server.',default='67108864'"`
+	GrpcChunkSize        int               `kong:"help='Size in bytes of the chunks gRPC uploads are streamed in. Larger chunks can improve throughput on high-latency links. Must fit into --grpc-max-call-send-size.',default='8388608'"`
+	GrpcHeader           map[string]string `kong:"help='Additional gRPC metadata header to send with every request to the store, given as KEY=VALUE. Can be repeated.'"`
+	GrpcKeepaliveTime    time.Duration     `kong:"help='Interval after which a keepalive ping is sent on an idle gRPC connection to the store. Disabled if zero.',default='0s'"`
+	GrpcKeepaliveTimeout time.Duration     `kong:"help='Time to wait for a keepalive ping to be acknowledged before the connection is considered dead.',default='20s'"`
+	GrpcConnectTimeout   time.Duration     `kong:"help='Wait up to this long for the gRPC connection to be established before uploading, and fail otherwise. Connections are established lazily if zero.',default='0s'"`
+	GrpcCompression      string            `kong:"enum='none,gzip',help='Compression of gRPC uploads. Uploads are retried uncompressed if the store does not support it.',default='none'"`
+	RateLimit            int64             `kong:"help='Maximum rate in bytes per second to upload at, shared by all parallel uploads and stores, e.g. to not saturate the egress of shared runners. Unlimited if zero.',default='0'"`
+	DisableStrategy      []string          `kong:"enum='grpc,signed-url',help='Fail uploads the store asks to perform with this strategy, e.g. if gRPC uploads are firewalled but HTTP egress works. The store chooses the strategy, so uploads cannot fall back to another one. Can be repeated.',placeholder='STRATEGY'"`
+	MultipartThreshold   int64             `kong:"help='Size in bytes above which files would have to be split into a multipart upload to be uploaded to a signed URL, e.g. 5GiB for S3. The debuginfo API has no multipart uploads, so such uploads fail before anything is sent. Unlimited if zero.',default='5368709120'"`
+}
+
+// extractFlags configure which debug information is extracted from binaries.
+type extractFlags struct {
+	NoSymtab          bool     `kong:"help='Drop the .symtab and .strtab symbol tables from the extracted debug information. The dynamic symbol table is kept.'"`
+	KeepEHFrame       bool     `kong:"name='keep-eh-frame',help='Keep the .eh_frame and .eh_frame_hdr unwind tables in the extracted debug information, for unwinding binaries without .debug_frame.'"`
+	DWARFCompression  string   `kong:"name='dwarf-compression',enum='none,zlib,zstd',help='Compress the DWARF sections of the extracted debug information as SHF_COMPRESSED sections. Older consumers only support zlib. With zstd the uncompressed debug information is buffered in memory.',default='none'"`
+	SynthesizeBuildID bool     `kong:"help='Give ELF files without a GNU Build ID note the SHA-1 of their .text section as Build ID, and add a .note.gnu.build-id section holding it to the extracted debug information. Go build IDs are not synthesized.'"`
+	ExcludeSection    []string `kong:"help='Drop the section with this name from the extracted debug information, after the other flags selected what to keep, e.g. .debug_pubnames. Build ID notes cannot be excluded. Can be repeated.',placeholder='SECTION'"`
+}
+
 type flags struct {
-	LogLevel string `kong:"enum='error,warn,info,debug',help='Log level.',default='info'"`
+	LogLevel    string           `kong:"enum='error,warn,info,debug',help='Log level.',default='info'"`
+	LogFormat   string           `kong:"enum='logfmt,json',help='Log format.',default='logfmt'"`
+	LogFile     string           `kong:"help='File to append logs to in addition to stderr. Parent directories are created if needed.',type:'path',placeholder='FILE'"`
+	BuildIDFrom string           `kong:"enum='auto,gnu,go',help='Build ID to identify ELF files by. Go binaries can carry both a GNU Build ID and a Go build ID. With auto the GNU Build ID is used, falling back to the Go build ID if there is none.',default='auto'"`
+	Bytes       bool             `kong:"help='Print sizes as raw byte counts instead of human-readable ones like 14.2 MiB.'"`
+	Quiet       bool             `kong:"help='Do not print informational messages to stdout.',xor='output'"`
+	Verbose     bool             `kong:"help='Print progress of every phase to stdout.',xor='output'"`
+	Version     kong.VersionFlag `kong:"help='Show application version.'"`
+	Config      kong.ConfigFlag  `kong:"help='Path to a YAML file to load flag defaults from. Flags and environment variables take precedence.',type:'path',placeholder='FILE'"`
 
 	Upload struct {
-		StoreAddress       string `kong:"required,help='gRPC address to sends symbols to.'"`
-		BearerToken        string `kong:"help='Bearer token to authenticate with store.',env='PARCA_DEBUGINFO_BEARER_TOKEN'"`
-		BearerTokenFile    string `kong:"help='File to read bearer token from to authenticate with store.'"`
-		Insecure           bool   `kong:"help='Send gRPC requests via plaintext instead of TLS.'"`
-		InsecureSkipVerify bool   `kong:"help='Skip TLS certificate verification.'"`
-		NoExtract          bool   `kong:"help='Do not extract debug information from binaries, just upload the binary as is.'"`
-		NoInitiate         bool   `kong:"help='Do not initiate the upload, just check if it should be initiated.'"`
-		Force              bool   `kong:"help='Force upload even if the Build ID is already uploaded.'"`
-		Type               string `kong:"enum='debuginfo,executable,sources',help='Type of the debug information to upload.',default='debuginfo'"`
-		BuildID            string `kong:"help='Build ID of the binary to upload.'"`
-
-		Path string `kong:"required,arg,name='path',help='Paths to upload.',type:'path'"`
+		storeFlags   `kong:"embed"`
+		extractFlags `kong:"embed"`
+
+		NoExtract              bool          `kong:"help='Do not extract debug information from binaries, just upload the binary as is.'"`
+		NoInitiate             bool          `kong:"help='Do not initiate the upload, just check if it should be initiated.'"`
+		Force                  bool          `kong:"help='Force upload even if the Build ID is already uploaded.'"`
+		ContinueOnError        bool          `kong:"help='Keep uploading the remaining files when a file fails and report all failures at the end.'"`
+		MaxErrors              int           `kong:"help='With --continue-on-error, abort once this many files failed and report the failures so far. Unlimited if zero.',default='0'"`
+		FailIfNothingUploaded  bool          `kong:"help='Exit with an error if no file was uploaded to any store, e.g. because all of them were skipped.'"`
+		Parallelism            int           `kong:"help='Number of files to extract and upload concurrently.',default='1'"`
+		Timings                bool          `kong:"help='Print how long extracting, hashing and uploading took for every file.'"`
+		Output                 string        `kong:"enum='text,json',help='Output format. With json, a JSON object with the timings and outcome of every file, including why stores skipped it, is printed per line instead of informational messages.',default='text'"`
+		SpillThreshold         int64         `kong:"help='Size in bytes up to which extracted debug information is buffered in memory before it is moved to a temporary file.',default='268435456'"`
+		FallbackUploadOriginal bool          `kong:"help='Upload binaries without DWARF as is as executable, instead of the debug information extracted from them, which only holds their headers, notes and symbol tables.'"`
+		RequireDwarf           bool          `kong:"help='Fail without uploading anything if debug information is to be extracted from a binary without DWARF.'"`
+		MaxInflightBytes       int64         `kong:"help='Maximum number of bytes of extracted debug information buffered in memory across all parallel uploads. Extractions wait until enough uploads finished. Unlimited if zero.',default='0'"`
+		VerifyLocalHash        bool          `kong:"help='Hash the content of every file while uploading it and fail instead of marking the upload as finished if it does not match the hash sent to the store.'"`
+		PostExtractHook        string        `kong:"help='Command to run on every extracted debuginfo file before uploading it, with the path of a temporary copy appended as argument. The upload of the file is aborted if the command fails. The command is run by sh, with PARCA_DEBUGINFO_SOURCE_PATH set to the path of the original file and PARCA_DEBUGINFO_BUILD_ID to its Build ID.',placeholder='CMD'"`
+		PostExtractHookReplace bool          `kong:"help='Upload the stdout of --post-extract-hook instead of the extracted debuginfo file, e.g. after signing it. Empty output fails the upload.'"`
+		SkipHash               bool          `kong:"help='Do not hash files before uploading them. Saves reading every file twice, but the store can no longer deduplicate uploads by content hash.'"`
+		Type                   string        `kong:"enum='auto,debuginfo,executable,sources',help='Type of the debug information to upload. With auto, ELF files with DWARF are uploaded as debuginfo, other binaries as executable and tar or zstd archives as sources.',default='debuginfo'"`
+		BuildID                string        `kong:"help='Build ID of the binary to upload.'"`
+		NewerThan              time.Duration `kong:"help='Only upload files modified within this duration before now, e.g. 24h. The Build ID of older files is not even read.',xor='mtime'"`
+		ChangedSince           time.Time     `kong:"help='Only upload files modified at or after this time, given in RFC 3339 format like 2006-01-02T15:04:05Z.',xor='mtime',placeholder='TIME'"`
+		WithSources            bool          `kong:"help='After uploading the debug information of an ELF file, also upload an archive of the source files its DWARF line tables reference as its sources, like the source command with --upload.'"`
+		SkipArchiveValidation  bool          `kong:"help='Do not check that source archives are zstd compressed tar archives before uploading them.'"`
+
+		MinBuildIDLength  int  `kong:"help='Minimum length in hex characters a Build ID must have to be uploaded.',default='16'"`
+		AllowShortBuildID bool `kong:"help='Allow uploading Build IDs shorter than --min-build-id-length, e.g. for unusual toolchains.'"`
+
+		GrpcConnectionPool bool `kong:"help='Open one gRPC connection per --parallelism worker to each store and use them round-robin, instead of sharing a single connection.'"`
+
+		MarkFinishedRetries   int    `kong:"help='Number of times to retry marking a transferred upload as finished if the store is temporarily unavailable.',default='3'"`
+		ShouldInitiateRetries int    `kong:"help='Number of times to retry asking a store whether it wants a file if the store is temporarily unavailable or does not answer in time.',default='3'"`
+		ResumeFile            string `kong:"help='File to record uploads in that were transferred but could not be marked as finished. They are marked as finished on the next run using the same file, without transferring them again.',type:'path'"`
+		SeenBuildIDsFile      string `kong:"name='seen-build-ids-file',help='File to record the Build IDs of uploaded files in. Files with a Build ID recorded by a previous run are skipped without asking the stores, unless --force is given.',type:'path',placeholder='FILE'"`
+
+		Arch []string `kong:"help='Only upload ELF files of this architecture (e.g. x86_64, aarch64, riscv64) and this architecture of multi-architecture files, i.e. Mach-O universal binaries (e.g. x86_64, arm64) and the native libraries of APKs (e.g. arm64-v8a). Files without an architecture, like source archives, are always uploaded. Can be repeated.'"`
+
+		SkipBuildID []string `kong:"help='Build ID to skip uploading. Can be repeated.'"`
+		OnlyBuildID []string `kong:"help='Only upload files with this Build ID. Can be repeated.'"`
+
+		WriteUploadManifest string `kong:"help='Write a JSON manifest recording the path, Build ID, type, hash and size of every uploaded file to this file, to upload the same files again with --from-manifest.',type:'path',placeholder='FILE'"`
+		FromManifest        string `kong:"help='Upload the files recorded by a --write-upload-manifest manifest again instead of the given paths. Fails if a file no longer has the recorded Build ID.',type:'existingfile',placeholder='FILE'"`
+
+		Paths []string `kong:"arg,optional,name='path',help='Paths to upload. The --type can be overridden per path by appending :<type>, e.g. app:executable.',type:'path'"`
 	} `cmd:"" help:"Upload debug information files."`
 
 	Extract struct {
-		OutputDir string `kong:"help='Output directory path to use for extracted debug information files.',default='out'"`
+		OutputDir            string   `kong:"help='Output directory path to use for extracted debug information files.',default='out'"`
+		WriteChecksums       bool     `kong:"help='Write the SHA-256 checksum of every extracted file to <buildid>.debuginfo.sha256 next to it.'"`
+		Force                bool     `kong:"help='Remove the output directory with all of its contents before extracting. Otherwise only previously extracted files are removed, and directories with other contents are refused.'"`
+		Fsync                bool     `kong:"name='fsync',help='Sync every written file and its directory to disk, and read its Build ID from disk again, before reporting success, e.g. for network filesystems.'"`
+		StrippedOut          string   `kong:"help='Write a copy of the binary without its DWARF debug information to this path, like objcopy --strip-debug. Requires --debug-out and a single path.',type:'path',placeholder='FILE'"`
+		DebugOut             string   `kong:"help='Write the debug information to this path instead of the output directory, like objcopy --only-keep-debug. Requires --stripped-out.',type:'path',placeholder='FILE'"`
+		AddDebuglink         bool     `kong:"name='add-debuglink',help='Add a .gnu_debuglink section with the name and CRC32 of --debug-out to the binary written to --stripped-out, replacing any previous one, like objcopy --add-gnu-debuglink, so that debuggers can find the debug information.'"`
+		DereferenceDebuglink bool     `kong:"name='dereference-debuglink',help='Extract the debug information of binaries without DWARF but with a .gnu_debuglink section from the separate debug file it links to instead, keyed by the Build ID of the binary. Fails if the debug file cannot be found.'"`
+		DebugFileDir         []string `kong:"help='Directory to look for the separate debug files of --dereference-debuglink in, like the debug-file-directory of gdb. Can be repeated.',default='/usr/lib/debug',type:'path',placeholder='DIR'"`
+
+		extractFlags `kong:"embed"`
 
-		Paths []string `kong:"required,arg,name='path',help='Paths to extract debug information.',type:'path'"`
+		Arch []string `kong:"help='Only extract ELF files of this architecture, e.g. x86_64, aarch64 or riscv64. Can be repeated.'"`
+
+		Paths []string `kong:"required,arg,name='path',help='Paths to extract debug information. With -, the file is read from stdin and the debug information is written to stdout.',type:'path'"`
 	} `cmd:"" help:"Extract debug information."`
 
 	Buildid struct {
 		Path string `kong:"required,arg,name='path',help='Paths to extract buildid.',type:'path'"`
-	} `cmd:"" help:"Extract buildid."`
+	} `cmd:"" help:"Extract buildid of an ELF or PE file."`
 
 	Source struct {
-		DebuginfoPath string `kong:"required,arg,name='debuginfo-path',help='Path to debuginfo file',type:'path'"`
-		OutPath       string `kong:"arg,name='out-path',help='Path to output archive file',type:'path',default='source.tar.zstd'"`
+		DebuginfoPath         string   `kong:"required,arg,name='debuginfo-path',help='Path to debuginfo file',type:'path'"`
+		OutPath               string   `kong:"arg,optional,name='out-path',help='Path to output archive file. Defaults to source.tar.zstd, or source.tar.br with --compression=brotli.',type:'path'"`
+		ListOnly              bool     `kong:"help='Only print the source files referenced by the debuginfo file, one per line, without building an archive.'"`
+		Estimate              bool     `kong:"help='Only print how many source files would be archived or are missing, and their total uncompressed size, without building an archive.'"`
+		StripComponents       int      `kong:"help='Strip this many leading components from the archived file names, like tar. The original paths are recorded in a manifest entry of the archive.',default='0'"`
+		RelativeTo            string   `kong:"help='Archive the files below this directory under their path relative to it, so that the archive extracts into a workspace. The original paths are recorded in a manifest entry of the archive.',type:'path',placeholder='DIR'"`
+		StrictRelative        bool     `kong:"help='Exclude the files that are not below --relative-to from the archive, instead of archiving them under their absolute path.'"`
+		Manifest              string   `kong:"help='Write a JSON manifest listing every referenced source file and whether it was included in the archive to this file.',type:'path',placeholder='FILE'"`
+		Compression           string   `kong:"enum='zstd,brotli',help='Compression of the archive. Stores expect zstd, so brotli cannot be used with --upload.',default='zstd'"`
+		CompressionLevel      int      `kong:"help='Compression level of the archive, from 1 (fastest) to 22 (smallest) for zstd and from 0 to 11 for brotli.',default='3'"`
+		SourceCache           string   `kong:"help='Record the content hash of every archived file in the --manifest, and cache the hashes in this directory across invocations, keyed by path and validated by size and modification time, so that unchanged files are not hashed again. The files are still read to archive them. Can be shared by parallel invocations.',type:'path',placeholder='DIR'"`
+		BufferSize            int      `kong:"help='Size in bytes of the buffer the compressed archive is written to the output file through.',default='65536'"`
+		MaxSourceFiles        int      `kong:"help='Maximum number of source files to add to the archive. The remaining ones are skipped. Unlimited if zero.',default='0'"`
+		FromDir               string   `kong:"help='Archive the files of this directory instead of the ones referenced by the DWARF line tables, e.g. for binaries without line information. Files matching the gitignore patterns of .parca-debuginfo-ignore files in the directory or its subdirectories are skipped. The debuginfo file still provides the Build ID.',xor='file-list',type:'existingdir',placeholder='DIR'"`
+		SourcesManifest       string   `kong:"help='Archive the files listed by this manifest instead of the ones referenced by the DWARF line tables, given as a JSON array of paths or one path per line. The debuginfo file still provides the Build ID.',xor='file-list',type:'existingfile',placeholder='FILE'"`
+		MergeDwarfSources     bool     `kong:"help='Also archive the files referenced by the DWARF line tables in addition to the ones of --sources-manifest.'"`
+		CanonicalPaths        string   `kong:"enum='none,clean,absolute',help='Canonicalize the source file names before archiving them: clean removes redundant separators and . and .. elements, absolute additionally makes relative names absolute. The original names are recorded in the --manifest.',default='none'"`
+		FollowGnuDebugaltlink bool     `kong:"help='Also discover source files from the supplementary DWARF file that .gnu_debugaltlink points to, as created by dwz.'"`
+		DebugaltlinkDir       []string `kong:"help='Directory to search for the .gnu_debugaltlink target in, by name and by Build ID like /usr/lib/debug. Can be repeated.',type:'path',placeholder='DIR'"`
+		Include               []string `kong:"help='Only archive the files of --from-dir whose relative path matches this glob, where ** matches any number of directories, e.g. **/*.go. Can be repeated.',placeholder='GLOB'"`
+		DebuginfodURL         []string `kong:"name='debuginfod-url',help='Fetch the source files that do not exist locally from this debuginfod server, by the Build ID of the debuginfo file. Can be repeated to try multiple servers in order.',placeholder='URL'"`
+		Upload                bool     `kong:"help='Upload the archive to the stores given by --store-address as sources of the Build ID of the debuginfo file, instead of writing it to out-path.'"`
+
+		storeFlags `kong:"embed"`
 	} `cmd:"" help:"Build a source archive by discovering files from a given debuginfo file."`
+
+	Decompress struct {
+		Path   string `kong:"required,arg,name='path',help='Path to the ELF file.',type:'path'"`
+		Output string `kong:"short='o',help='Path to write the decompressed ELF file to. Defaults to <path>.decompressed.',type:'path'"`
+	} `cmd:"" help:"Write a copy of an ELF file with all compressed sections decompressed."`
+
+	Info struct {
+		Path   string `kong:"required,arg,name='path',help='Path to the debuginfo file.',type:'path'"`
+		Output string `kong:"enum='text,json',help='Output format.',default='text'"`
+	} `cmd:"" help:"Summarize the contents of a debuginfo file."`
+
+	Symbolize struct {
+		DebuginfoPath string `kong:"required,arg,name='debuginfo-path',help='Path to the debuginfo file.',type:'path'"`
+		Address       string `kong:"required,arg,name='address',help='Virtual address to resolve, in hex with 0x prefix or in decimal.'"`
+		Output        string `kong:"enum='text,json',help='Output format.',default='text'"`
+	} `cmd:"" help:"Resolve an address to its function, file and line with the DWARF debug information of a file, to check that it is usable."`
+
+	Status struct {
+		storeFlags `kong:"embed"`
+
+		Type    string   `kong:"enum='auto,debuginfo,executable,sources',help='Type of the debug information to look up, like for upload.',default='debuginfo'"`
+		BuildID string   `kong:"help='Build ID to look up the files with, e.g. for source archives.'"`
+		Output  string   `kong:"enum='text,json',help='Output format. With json, a JSON object per file and store is printed per line.',default='text'"`
+		Paths   []string `kong:"required,arg,name='path',help='Paths of the files to look up. Like for upload, :type can be appended to a path to override --type for it.',type:'path'"`
+	} `cmd:"" help:"Show which files are already in the stores, without uploading anything."`
+
+	Selftest struct {
+		storeFlags `kong:"embed"`
+	} `cmd:"" help:"Check the installation by extracting debug information from a synthesized ELF file and, with --store-address, uploading it."`
+
+	Ping struct {
+		storeFlags `kong:"embed"`
+
+		Output string `kong:"enum='text,json',help='Output format. With json, a JSON object with the outcome of every store is printed per line.',default='text'"`
+	} `cmd:"" help:"Check that the stores are reachable and accept the bearer token, before uploading."`
+
+	Schema struct{} `cmd:"" hidden:"" help:"Print a JSON description of all commands and flags, for tools that wrap the CLI."`
+
+	VersionCmd struct {
+		Output string `kong:"enum='text,json',help='Output format.',default='text'"`
+	} `cmd:"" name:"version" help:"Show build information."`
 }
 
 func main() {
 	flags := flags{}
-	kongCtx := kong.Parse(&flags)
-	if err := run(kongCtx, flags); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	kongCtx := kong.Parse(&flags,
+		kong.Configuration(configLoader),
+		kong.Vars{"version": getBuildInfo().String()},
+	)
+	var logWriter io.Writer = os.Stderr
+	if flags.LogFile != "" {
+		f, err := openLogFile(flags.LogFile)
+		kongCtx.FatalIfErrorf(err)
+		defer f.Close()
+		logWriter = io.MultiWriter(os.Stderr, f)
+	}
+	logger := newLogger(flags, logWriter)
+	if err := run(kongCtx, logger, flags); err != nil {
+		level.Error(logger).Log("err", err)
+		// Log file writes are unbuffered, so nothing is lost by not
+		// running the deferred close.
+		if errors.As(err, &grun.SignalError{}) {
+			os.Exit(exitInterrupted) //nolint:gocritic
+		}
 		os.Exit(1)
 	}
 }
 
-func run(kongCtx *kong.Context, flags flags) error {
+// exitInterrupted is the exit code when a signal stopped the command, like
+// shells report commands terminated by SIGINT.
+const exitInterrupted = 130
+
+// configLoader loads flag defaults from a YAML config file, whose keys mirror
+// the flag names nested by command, e.g.:
+//
+//	upload:
+//	  store-address: grpc.polarsignals.com:443
+//
+// Kong resolves env vars before config files, so flags set through their env
+// var are skipped here to let the env var take precedence over the file.
+func configLoader(r io.Reader) (kong.Resolver, error) {
+	resolver, err := kongyaml.Loader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return kong.ResolverFunc(func(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+		for _, env := range flag.Tag.Envs {
+			if _, ok := os.LookupEnv(env); ok {
+				return nil, nil //nolint:nilnil
+			}
+		}
+		return resolver.Resolve(ctx, parent, flag)
+	}), nil
+}
+
+func run(kongCtx *kong.Context, logger log.Logger, flags flags) error {
 	var g grun.Group
 	ctx, cancel := context.WithCancel(context.Background())
 	switch kongCtx.Command() {
-	case "upload <path>":
+	case "upload", "upload <path>":
 		g.Add(func() error {
-			conn, err := grpcConn(prometheus.NewRegistry(), flags)
-			if err != nil {
-				return fmt.Errorf("create gRPC connection: %w", err)
+			if flags.Upload.FromManifest != "" && len(flags.Upload.Paths) > 0 {
+				return errors.New("paths cannot be combined with --from-manifest")
+			}
+			if flags.Upload.FromManifest != "" && flags.Upload.BuildID != "" {
+				return errors.New("--build-id cannot be used with --from-manifest, the manifest records the Build IDs")
+			}
+			if flags.Upload.FromManifest == "" && len(flags.Upload.Paths) == 0 {
+				return errors.New("expected at least one path to upload, or --from-manifest")
+			}
+			if err := validateExtractFlags(flags.Upload.extractFlags); err != nil {
+				return err
+			}
+			if flags.Upload.Parallelism < 1 {
+				return fmt.Errorf("--parallelism must be at least 1, got %d", flags.Upload.Parallelism)
+			}
+			if flags.Upload.VerifyLocalHash && flags.Upload.SkipHash {
+				return errors.New("--verify-local-hash cannot be used with --skip-hash")
+			}
+			if flags.Upload.MaxErrors < 0 {
+				return errors.New("--max-errors must not be negative")
+			}
+			if flags.Upload.MaxErrors > 0 && !flags.Upload.ContinueOnError {
+				return errors.New("--max-errors can only be used with --continue-on-error")
+			}
+			if flags.Upload.SynthesizeBuildID && flags.Upload.NoExtract {
+				return errors.New("--synthesize-build-id cannot be used with --no-extract, the Build ID note is added to the extracted debug information")
+			}
+			if flags.Upload.MarkFinishedRetries < 0 {
+				return errors.New("--mark-finished-retries must not be negative")
+			}
+			if flags.Upload.ShouldInitiateRetries < 0 {
+				return errors.New("--should-initiate-retries must not be negative")
+			}
+			if flags.Upload.SpillThreshold < 0 {
+				return errors.New("--spill-threshold must not be negative")
+			}
+			if flags.Upload.NewerThan < 0 {
+				return errors.New("--newer-than must not be negative")
+			}
+			if flags.Upload.MaxInflightBytes < 0 {
+				return errors.New("--max-inflight-bytes must not be negative")
 			}
-			defer conn.Close()
-
-			debuginfoClient := debuginfopb.NewDebuginfoServiceClient(conn)
-			grpcUploadClient := parcadebuginfo.NewGrpcUploadClient(debuginfoClient)
-
-			var (
-				buildID string
-				reader  io.ReadSeeker
-				size    int64
-			)
 
-			if !flags.Upload.NoExtract && flags.Upload.Type == "debuginfo" {
-				f, err := os.Open(flags.Upload.Path)
-				if err != nil {
-					return fmt.Errorf("open file: %w", err)
+			poolSize := 1
+			if flags.Upload.GrpcConnectionPool {
+				poolSize = flags.Upload.Parallelism
+			}
+			clients, err := newStoreClients(ctx, flags.Upload.storeFlags, poolSize, uploadOptions{
+				force:           flags.Upload.Force,
+				noInitiate:      flags.Upload.NoInitiate,
+				skipHash:        flags.Upload.SkipHash,
+				verifyLocalHash: flags.Upload.VerifyLocalHash,
+
+				markFinishedRetries:   flags.Upload.MarkFinishedRetries,
+				shouldInitiateRetries: flags.Upload.ShouldInitiateRetries,
+			})
+			if err != nil {
+				return err
+			}
+			defer closeStoreClients(clients)
+
+			// With --continue-on-error, failures of individual files are
+			// collected and returned once every other file was processed,
+			// or once --max-errors files failed.
+			var errs []error
+			fail := func(err error) error {
+				if !flags.Upload.ContinueOnError {
+					return err
 				}
-
-				ef, err := elf.NewFile(f)
-				if err != nil {
-					return fmt.Errorf("open ELF file: %w", err)
+				level.Error(logger).Log("msg", "failed to upload file", "err", err)
+				errs = append(errs, err)
+				if flags.Upload.MaxErrors > 0 && len(errs) >= flags.Upload.MaxErrors {
+					return fmt.Errorf("aborting after %d failed files: %w", len(errs), errors.Join(errs...))
 				}
-				defer ef.Close()
+				return nil
+			}
 
-				buildID, err = GetBuildID(ef)
+			// Finish the uploads a previous run transferred but could not
+			// mark as finished, before the stores are asked whether they
+			// want the files again.
+			var unfinished []unfinishedUpload
+			if flags.Upload.ResumeFile != "" {
+				resumed, err := readResumeFile(flags.Upload.ResumeFile)
 				if err != nil {
-					return fmt.Errorf("get Build ID for %q: %w", flags.Upload.Path, err)
+					return err
 				}
+				unfinished = finishUploads(ctx, logger, flags, clients, resumed)
+			}
 
-				buf := &flexbuf.Buffer{}
-				if err := elfwriter.OnlyKeepDebug(buf, f); err != nil {
-					return fmt.Errorf("failed to extract debug information: %w", err)
+			var seen *seenBuildIDs
+			if flags.Upload.SeenBuildIDsFile != "" {
+				seen, err = openSeenBuildIDs(flags.Upload.SeenBuildIDsFile)
+				if err != nil {
+					return err
 				}
+				defer seen.Close()
+			}
 
-				size = int64(buf.Len())
-				buf.SeekStart()
-				reader = buf
+			since := flags.Upload.ChangedSince
+			if flags.Upload.NewerThan > 0 {
+				since = time.Now().Add(-flags.Upload.NewerThan)
+			}
 
-				if size == 0 {
-					return fmt.Errorf("extracted debug information from %q is empty, but must not be empty", flags.Upload.Path)
+			// The files of a manifest are resolved like paths, and
+			// only the recorded uploads of them are kept.
+			var targets []manifestTarget
+			if flags.Upload.FromManifest != "" {
+				targets, err = readUploadManifest(flags.Upload.FromManifest)
+				if err != nil {
+					return err
 				}
 			} else {
-				buildID = flags.Upload.BuildID
+				for _, arg := range flags.Upload.Paths {
+					path, typ := splitPathType(arg, flags.Upload.Type)
+					targets = append(targets, manifestTarget{path: path, typ: typ})
+				}
+			}
 
-				if flags.Upload.Type == "debuginfo" && buildID == "" {
-					ef, err := elf.Open(flags.Upload.Path)
+			uploads := make([]*uploadInfo, 0, len(targets))
+			for _, t := range targets {
+				path, typ := t.path, t.typ
+				if !since.IsZero() {
+					modified, err := modifiedSince(path, since)
 					if err != nil {
-						return fmt.Errorf("open ELF file: %w", err)
+						if err := fail(err); err != nil {
+							return err
+						}
+						continue
 					}
-					defer ef.Close()
-
-					buildID, err = GetBuildID(ef)
-					if err != nil {
-						return fmt.Errorf("get Build ID for %q: %w", flags.Upload.Path, err)
+					if !modified {
+						verbosef(flags, "Skipping %q as it was not modified since %s", path, since.Format(time.RFC3339))
+						continue
 					}
 				}
-
-				f, err := os.Open(flags.Upload.Path)
-				if err != nil {
-					return fmt.Errorf("open file: %w", err)
+				resolveFlags := flags
+				if len(t.entries) == 1 && t.entries[0].BuildIDFromFlag {
+					resolveFlags.Upload.BuildID = t.entries[0].BuildID
 				}
-				defer f.Close()
-
-				fi, err := f.Stat()
-				if err != nil {
-					return fmt.Errorf("stat file: %w", err)
+				pathUploads, err := resolveUploads(logger, resolveFlags, path, typ)
+				if err == nil && t.entries != nil {
+					pathUploads, err = matchManifestEntries(t, pathUploads)
 				}
-
-				if fi.Size() == 0 {
-					return fmt.Errorf("file %q is empty, but must not be empty", flags.Upload.Path)
+				if err != nil {
+					if err := fail(err); err != nil {
+						return err
+					}
+					continue
 				}
-				reader = f
-				size = fi.Size()
-			}
-
-			shouldInitiate, err := debuginfoClient.ShouldInitiateUpload(ctx, &debuginfopb.ShouldInitiateUploadRequest{
-				BuildId: buildID,
-				Force:   flags.Upload.Force,
-				Type:    debuginfoTypeStringToPb(flags.Upload.Type),
-			})
-			if err != nil {
-				return fmt.Errorf("check if upload should be initiated for %q with Build ID %q: %w", flags.Upload.Path, buildID, err)
-			}
-			if !shouldInitiate.GetShouldInitiateUpload() {
-				fmt.Fprintf(os.Stdout, "Skipping upload of %q with Build ID %q as the store instructed not to: %s\n", flags.Upload.Path, buildID, shouldInitiate.GetReason())
-				return nil
+				uploads = append(uploads, pathUploads...)
 			}
 
-			if flags.Upload.NoInitiate {
-				fmt.Fprintf(os.Stdout, "Not initiating upload of %q with Build ID %q as requested, but would have requested that next, because: %s\n", flags.Upload.Path, buildID, shouldInitiate.GetReason())
-				return nil
+			selected := filterUploads(flags, seen, uploads)
+			if err := checkDWARF(logger, flags, selected); err != nil {
+				return err
 			}
 
-			hash, err := hash.Reader(reader)
-			if err != nil {
-				return fmt.Errorf("calculate hash of %q with Build ID %q: %w", flags.Upload.Path, buildID, err)
-			}
+			// Uploads are distributed to --parallelism workers. The first
+			// failure cancels all in-flight uploads, or with
+			// --continue-on-error the one reaching --max-errors.
+			uploadCtx, cancelUploads := context.WithCancel(ctx)
+			defer cancelUploads()
 
-			if _, err := reader.Seek(0, io.SeekStart); err != nil {
-				return fmt.Errorf("seek to start of %q with Build ID %q: %w", flags.Upload.Path, buildID, err)
+			var (
+				wg       sync.WaitGroup
+				mu       sync.Mutex
+				abortErr error
+			)
+			var inflight *semaphore.Weighted
+			if flags.Upload.MaxInflightBytes > 0 {
+				inflight = semaphore.NewWeighted(flags.Upload.MaxInflightBytes)
 			}
-
-			initiationResp, err := debuginfoClient.InitiateUpload(ctx, &debuginfopb.InitiateUploadRequest{
-				BuildId: buildID,
-				Hash:    hash,
-				Size:    size,
-				Force:   flags.Upload.Force,
-				Type:    debuginfoTypeStringToPb(flags.Upload.Type),
-			})
-			if err != nil {
-				return fmt.Errorf("initiate upload for %q with Build ID %q: %w", flags.Upload.Path, buildID, err)
+			work := make(chan *uploadInfo)
+			for range flags.Upload.Parallelism {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for upload := range work {
+						err := uploadFile(uploadCtx, logger, flags, clients, inflight, upload)
+						if err == nil && flags.Upload.WithSources && upload.hasSources() {
+							err = uploadSources(uploadCtx, logger, flags, clients, upload)
+						}
+						reportTimings(flags, upload, err)
+						if err == nil {
+							upload.finishedAt = time.Now()
+							// Nothing was uploaded with --no-initiate.
+							if seen != nil && !flags.Upload.NoInitiate {
+								if err := seen.add(upload.buildID, upload.typ); err != nil {
+									level.Warn(logger).Log("msg", "failed to record uploaded Build ID", "path", upload.path, "build_id", upload.buildID, "err", err)
+								}
+							}
+							continue
+						}
+						mu.Lock()
+						if err := fail(err); err != nil && abortErr == nil {
+							abortErr = err
+							cancelUploads()
+						}
+						mu.Unlock()
+					}
+				}()
 			}
 
-			if flags.LogLevel == LogLevelDebug {
-				fmt.Fprintf(os.Stdout, "Upload instructions\nBuildID: %s\nUploadID: %s\nUploadStrategy: %s\nSignedURL: %s\nType: %s\n", initiationResp.GetUploadInstructions().GetBuildId(), initiationResp.GetUploadInstructions().GetUploadId(), initiationResp.GetUploadInstructions().GetUploadStrategy().String(), initiationResp.GetUploadInstructions().GetSignedUrl(), initiationResp.GetUploadInstructions().GetType())
+		feed:
+			for _, upload := range selected {
+				select {
+				case work <- upload:
+				case <-uploadCtx.Done():
+					break feed
+				}
 			}
+			close(work)
+			wg.Wait()
 
-			switch initiationResp.GetUploadInstructions().GetUploadStrategy() {
-			case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_GRPC:
-				if flags.LogLevel == LogLevelDebug {
-					fmt.Fprintf(os.Stdout, "Performing a gRPC upload for %q with Build ID %q.", flags.Upload.Path, buildID)
+			if flags.Upload.ResumeFile != "" {
+				for _, upload := range uploads {
+					unfinished = append(unfinished, upload.unfinished...)
 				}
-				_, err = grpcUploadClient.Upload(ctx, initiationResp.GetUploadInstructions(), reader)
-			case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL:
-				if flags.LogLevel == LogLevelDebug {
-					fmt.Fprintf(os.Stdout, "Performing a signed URL upload for %q with Build ID %q.", flags.Upload.Path, buildID)
+				if err := writeResumeFile(flags.Upload.ResumeFile, unfinished); err != nil {
+					return err
 				}
-				err = uploadViaSignedURL(ctx, initiationResp.GetUploadInstructions().GetSignedUrl(), reader)
-			case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_UNSPECIFIED:
-				err = errors.New("no upload strategy specified")
-			default:
-				err = fmt.Errorf("unknown upload strategy: %v", initiationResp.GetUploadInstructions().GetUploadStrategy())
 			}
-			if err != nil {
-				return fmt.Errorf("upload %q with Build ID %q: %w", flags.Upload.Path, buildID, err)
+			if flags.Upload.WriteUploadManifest != "" {
+				if err := writeUploadManifest(flags.Upload.WriteUploadManifest, flags, selected); err != nil {
+					return err
+				}
 			}
 
-			_, err = debuginfoClient.MarkUploadFinished(ctx, &debuginfopb.MarkUploadFinishedRequest{
-				BuildId:  buildID,
-				UploadId: initiationResp.GetUploadInstructions().GetUploadId(),
-				Type:     debuginfoTypeStringToPb(flags.Upload.Type),
-			})
-			if err != nil {
-				return fmt.Errorf("mark upload finished for %q with Build ID %q: %w", flags.Upload.Path, buildID, err)
+			// The context is only canceled by a signal, tell the user
+			// what is left to upload.
+			if ctx.Err() != nil {
+				printInterruptSummary(os.Stderr, selected)
+				return ctx.Err()
+			}
+			if abortErr != nil {
+				return abortErr
+			}
+			if err := errors.Join(errs...); err != nil {
+				return err
+			}
+			if flags.Upload.FailIfNothingUploaded && !slices.ContainsFunc(uploads, func(u *uploadInfo) bool { return u.uploaded > 0 }) {
+				return errors.New("nothing was uploaded")
 			}
-
 			return nil
 		}, func(error) {
 			cancel()
 		})
 
 	case "extract <path>":
+		tmps := &tempFiles{sync: flags.Extract.Fsync}
 		g.Add(func() error {
-			if err := os.RemoveAll(flags.Extract.OutputDir); err != nil {
+			if err := validateExtractFlags(flags.Extract.extractFlags); err != nil {
+				return err
+			}
+
+			// With -, the file is read from stdin and the debug
+			// information written to stdout instead of the output
+			// directory.
+			if slices.Contains(flags.Extract.Paths, "-") {
+				if len(flags.Extract.Paths) > 1 {
+					return errors.New("- cannot be combined with other paths")
+				}
+				if flags.Extract.WriteChecksums {
+					return errors.New("--write-checksums cannot be used when writing to stdout")
+				}
+				if flags.Extract.DereferenceDebuglink {
+					return errors.New("--dereference-debuglink cannot be used when reading from stdin")
+				}
+				return extractStdio(logger, os.Stdin, os.Stdout, flags.Extract.extractFlags, flags.BuildIDFrom)
+			}
+
+			if (flags.Extract.StrippedOut == "") != (flags.Extract.DebugOut == "") {
+				return errors.New("--stripped-out and --debug-out must be used together")
+			}
+			if flags.Extract.AddDebuglink && flags.Extract.StrippedOut == "" {
+				return errors.New("--add-debuglink requires --stripped-out and --debug-out")
+			}
+			if flags.Extract.StrippedOut != "" {
+				if len(flags.Extract.Paths) > 1 {
+					return errors.New("--stripped-out and --debug-out require a single path")
+				}
+				if flags.Extract.WriteChecksums {
+					return errors.New("--write-checksums cannot be used with --stripped-out and --debug-out")
+				}
+				if flags.Extract.DereferenceDebuglink {
+					return errors.New("--dereference-debuglink cannot be used with --stripped-out and --debug-out")
+				}
+				if flags.Extract.SynthesizeBuildID {
+					return errors.New("--synthesize-build-id cannot be used with --stripped-out and --debug-out")
+				}
+				path := flags.Extract.Paths[0]
+				verbosef(flags, "Splitting %q into %q and %q", path, flags.Extract.StrippedOut, flags.Extract.DebugOut)
+				if err := splitDebug(logger, path, flags.Extract.StrippedOut, flags.Extract.DebugOut, flags.Extract.AddDebuglink, flags.Extract.extractFlags, flags.BuildIDFrom, tmps); err != nil {
+					return fmt.Errorf("failed to split debug information of %q: %w", path, err)
+				}
+				return nil
+			}
+
+			if err := cleanOutputDir(flags.Extract.OutputDir, flags.Extract.Force); err != nil {
 				return fmt.Errorf("failed to clean output dir, %s: %w", flags.Extract.OutputDir, err)
 			}
 			if err := os.MkdirAll(flags.Extract.OutputDir, 0o755); err != nil { //nolint:mnd
@@ -267,12 +701,33 @@ func run(kongCtx *kong.Context, flags flags) error {
 				}
 				defer ef.Close()
 
-				buildID, err := GetBuildID(ef)
+				arch := elfArch(ef)
+				if len(flags.Extract.Arch) > 0 && !slices.Contains(flags.Extract.Arch, arch) {
+					infof(flags, "Skipping %q as its architecture %s is not in --arch", path, arch)
+					continue
+				}
+
+				buildID, synthesized, err := getExtractBuildID(ef, flags.BuildIDFrom, flags.Extract.extractFlags)
 				if err != nil {
 					return fmt.Errorf("get Build ID for %q: %w", path, err)
 				}
 
-				f, err := os.Open(path)
+				// The debug information of a stripped binary is read
+				// from the separate debug file it links to, which
+				// need not have a Build ID note of its own.
+				from := path
+				if flags.Extract.DereferenceDebuglink && !hasDWARFSections(ef) {
+					if name, crc, err := readDebugLink(ef); err == nil {
+						from, err = findDebugLinkFile(path, name, crc, buildID, flags.Extract.DebugFileDir)
+						if err != nil {
+							return err
+						}
+					} else if !errors.Is(err, errNoDebugLink) {
+						return fmt.Errorf("read debuglink of %q: %w", path, err)
+					}
+				}
+
+				f, err := os.Open(from)
 				if err != nil {
 					return fmt.Errorf("open file: %w", err)
 				}
@@ -281,37 +736,60 @@ func run(kongCtx *kong.Context, flags flags) error {
 				// ./out/<buildid>.debuginfo
 				output := filepath.Join(flags.Extract.OutputDir, buildID+".debuginfo")
 
-				outFile, err := os.Create(output)
-				if err != nil {
-					return fmt.Errorf("create output file: %w", err)
+				if from != path {
+					verbosef(flags, "Extracting debug information of %q (%s) from its debug file %q to %q", path, arch, from, output)
+				} else {
+					verbosef(flags, "Extracting debug information from %q (%s) to %q", path, arch, output)
 				}
-				defer outFile.Close()
-
-				if err := elfwriter.OnlyKeepDebug(outFile, f); err != nil {
+				var checksum []byte
+				if err := tmps.writeFile(output, func(out *os.File) error {
+					if err := extractDebugInfo(logger, out, f, flags.Extract.extractFlags, synthesized, defaultSpillThreshold); err != nil {
+						return err
+					}
+					if err := verifyExtractedBuildID(out, buildID, flags.BuildIDFrom); err != nil && (from == path || !errors.Is(err, ErrNoBuildID)) {
+						return err
+					}
+					if !flags.Extract.WriteChecksums {
+						return nil
+					}
+					checksum, err = sha256File(out)
+					return err
+				}); err != nil {
 					return fmt.Errorf("failed to extract debug information: %w", err)
 				}
+				if flags.Extract.Fsync {
+					if err := verifyOutputBuildID(output, buildID, flags.BuildIDFrom); err != nil && (from == path || !errors.Is(err, ErrNoBuildID)) {
+						return err
+					}
+				}
+
+				if flags.Extract.WriteChecksums {
+					// Same format as sha256sum, so that it can be verified with sha256sum -c.
+					if err := tmps.writeFile(output+".sha256", func(out *os.File) error {
+						_, err := fmt.Fprintf(out, "%x  %s\n", checksum, filepath.Base(output))
+						return err
+					}); err != nil {
+						return fmt.Errorf("failed to write checksum: %w", err)
+					}
+				}
 			}
 
 			return nil
 		}, func(error) {
 			cancel()
+			// Do not leave partially written files behind when interrupted.
+			tmps.removeAll()
 		})
 
 	case "buildid <path>":
 		g.Add(func() error {
-			ef, err := elf.Open(flags.Buildid.Path)
-			if err != nil {
-				return fmt.Errorf("open ELF file: %w", err)
-			}
-			defer ef.Close()
-
-			buildID, err := GetBuildID(ef)
+			buildID, err := getFileBuildID(flags.Buildid.Path, flags.BuildIDFrom)
 			if err != nil {
 				return fmt.Errorf("get Build ID for %q: %w", flags.Buildid.Path, err)
 			}
 
 			if buildID == "" {
-				return errors.New("failed to extract ELF build ID")
+				return errors.New("failed to extract build ID")
 			}
 
 			fmt.Fprintf(os.Stdout, "%s", buildID)
@@ -322,109 +800,1482 @@ func run(kongCtx *kong.Context, flags flags) error {
 
 	case "source <debuginfo-path>":
 		g.Add(func() error {
+			if flags.Source.StripComponents < 0 {
+				return errors.New("--strip-components must not be negative")
+			}
+			if flags.Source.MaxSourceFiles < 0 {
+				return errors.New("--max-source-files must not be negative")
+			}
+			if flags.Source.BufferSize <= 0 {
+				return errors.New("--buffer-size must be positive")
+			}
+			if err := validateSourceCompression(flags.Source.Compression, flags.Source.CompressionLevel); err != nil {
+				return err
+			}
+			if flags.Source.Upload && flags.Source.Compression != "zstd" {
+				return fmt.Errorf("--compression=%s cannot be used with --upload, stores expect zstd compressed sources", flags.Source.Compression)
+			}
+			if flags.Source.OutPath == "" {
+				flags.Source.OutPath = "source" + sourceArchiveExtension(flags.Source.Compression)
+			}
+
+			if flags.Source.StrictRelative && flags.Source.RelativeTo == "" {
+				return errors.New("--strict-relative requires --relative-to")
+			}
+			if len(flags.Source.Include) > 0 && flags.Source.FromDir == "" {
+				return errors.New("--include requires --from-dir")
+			}
+			if flags.Source.SourceCache != "" && flags.Source.Manifest == "" {
+				return errors.New("--source-cache requires --manifest, which records the hashes")
+			}
+			if flags.Source.MergeDwarfSources && flags.Source.SourcesManifest == "" {
+				return errors.New("--merge-dwarf-sources requires --sources-manifest")
+			}
+			for _, pattern := range flags.Source.Include {
+				if err := validateGlob(pattern); err != nil {
+					return fmt.Errorf("invalid --include pattern %q: %w", pattern, err)
+				}
+			}
+			var debuginfod *debuginfodClient
+			if len(flags.Source.DebuginfodURL) > 0 {
+				var err error
+				debuginfod, err = newDebuginfodClient(flags.Source.DebuginfodURL, &http.Client{
+					Transport: &userAgentTransport{rt: http.DefaultTransport, userAgent: userAgent(flags.Source.storeFlags)},
+				})
+				if err != nil {
+					return err
+				}
+			}
+
 			f, err := elf.Open(flags.Source.DebuginfoPath)
 			if err != nil {
 				return fmt.Errorf("open elf: %w", err)
 			}
 			defer f.Close()
 
-			sf, err := os.Create(flags.Source.OutPath)
-			if err != nil {
-				return fmt.Errorf("create source archive: %w", err)
+			// Files are discovered from the DWARF line tables, unless a
+			// directory or a manifest is given to archive instead.
+			var names []string
+			if flags.Source.SourcesManifest != "" {
+				names, err = readSourcesManifest(flags.Source.SourcesManifest)
+				if err != nil {
+					return err
+				}
+			}
+			switch {
+			case flags.Source.FromDir != "":
+				names, err = dirSourceFileNames(ctx, flags.Source.FromDir, flags.Source.Include)
+				if err != nil {
+					return err
+				}
+			case flags.Source.SourcesManifest != "" && !flags.Source.MergeDwarfSources:
+				// Only the files of the manifest are archived.
+			default:
+				d, err := openDWARF(f)
+				if err != nil {
+					return fmt.Errorf("get dwarf data: %w", err)
+				}
+
+				ds := []*dwarfData{d}
+				if flags.Source.FollowGnuDebugaltlink {
+					alt, err := debugAltDWARF(flags, f)
+					if err != nil {
+						return err
+					}
+					if alt != nil {
+						ds = append(ds, alt)
+					}
+				}
+
+				names, err = sourceFileNames(ctx, logger, names, ds...)
+				if err != nil {
+					return err
+				}
 			}
-			defer sf.Close()
 
-			zw, err := zstd.NewWriter(sf)
+			names, originalPaths, err := canonicalSourceNames(names, flags.Source.CanonicalPaths)
 			if err != nil {
-				return fmt.Errorf("create zstd writer: %w", err)
+				return err
 			}
-			defer zw.Close()
-
-			tw := tar.NewWriter(zw)
-			defer tw.Close()
 
-			d, err := f.DWARF()
-			if err != nil {
-				return fmt.Errorf("get dwarf data: %w", err)
+			if flags.Source.ListOnly {
+				for _, name := range names {
+					fmt.Fprintln(os.Stdout, name)
+				}
+				return nil
 			}
 
-			r := d.Reader()
-			seen := map[string]struct{}{}
-			for {
-				e, err := r.Next()
+			if flags.Source.Estimate {
+				e, err := newSourceArchiver(logger, nil, names, sourceArchiveOptions{
+					stripComponents: flags.Source.StripComponents,
+					relativeTo:      flags.Source.RelativeTo,
+					strictRelative:  flags.Source.StrictRelative,
+					maxFiles:        flags.Source.MaxSourceFiles,
+				}).estimate()
 				if err != nil {
-					return fmt.Errorf("read DWARF entry: %w", err)
-				}
-				if e == nil {
-					break
+					return err
 				}
+				fmt.Fprintf(os.Stdout, "Referenced source files: %d\nIncluded: %d\nMissing: %d\nExcluded: %d\nTotal uncompressed size: %s\n", e.referenced, e.included, e.missing, e.excluded, formatSize(flags, e.size))
+				return nil
+			}
 
-				if e.Tag == dwarf.TagCompileUnit {
-					lr, err := d.LineReader(e)
-					if err != nil {
-						return fmt.Errorf("get line reader: %w", err)
-					}
-
-					if lr == nil {
-						continue
-					}
+			var cache *sourceCache
+			if flags.Source.SourceCache != "" {
+				cache, err = openSourceCache(flags.Source.SourceCache)
+				if err != nil {
+					return err
+				}
+			}
 
-					for _, lineFile := range lr.Files() {
-						if lineFile == nil {
-							continue
-						}
-						if _, ok := seen[lineFile.Name]; !ok {
-							sourceFile, err := os.Open(lineFile.Name)
-							if errors.Is(err, os.ErrNotExist) {
-								fmt.Fprintf(os.Stderr, "skipping file %q: does not exist\n", lineFile.Name)
-								seen[lineFile.Name] = struct{}{}
-								continue
-							}
-							if err != nil {
-								return fmt.Errorf("open file: %w", err)
-							}
+			// With --upload the archive is built in memory and uploaded as
+			// the sources of the Build ID of the debuginfo file, if any of
+			// the stores want it.
+			var (
+				archive io.Writer
+				buf     *flexbuf.Buffer
+				bw      *bufio.Writer
+				upload  *uploadInfo
+				pending []*storeClient
+				errs    []error
+			)
+			buildID, err := getELFBuildID(f, flags.BuildIDFrom)
+			if err != nil && (flags.Source.Upload || !errors.Is(err, ErrNoBuildID)) {
+				return fmt.Errorf("get Build ID for %q: %w", flags.Source.DebuginfoPath, err)
+			}
 
-							stat, err := sourceFile.Stat()
-							if err != nil {
-								return fmt.Errorf("stat file: %w", err)
-							}
+			if flags.Source.Upload {
+				clients, err := newStoreClients(ctx, flags.Source.storeFlags, 1, uploadOptions{})
+				if err != nil {
+					return err
+				}
+				defer closeStoreClients(clients)
 
-							if err := tw.WriteHeader(&tar.Header{
-								Name: lineFile.Name,
-								Size: stat.Size(),
-							}); err != nil {
-								return fmt.Errorf("write tar header: %w", err)
-							}
+				upload = &uploadInfo{
+					path:    "sources of " + flags.Source.DebuginfoPath,
+					buildID: buildID,
+					typ:     debuginfopb.DebuginfoType_DEBUGINFO_TYPE_SOURCES,
+				}
+				pending, err = pendingStores(ctx, flags, clients, upload)
+				if len(pending) == 0 {
+					return err
+				}
+				errs = append(errs, err)
 
-							if _, err = io.Copy(tw, sourceFile); err != nil {
-								return fmt.Errorf("copy file to tar: %w", err)
-							}
+				buf = &flexbuf.Buffer{}
+				archive = buf
+			} else {
+				sf, err := os.Create(flags.Source.OutPath)
+				if err != nil {
+					return fmt.Errorf("create source archive: %w", err)
+				}
+				defer sf.Close()
+				// Buffer the many small writes of archives of small
+				// files.
+				bw = bufio.NewWriterSize(sf, flags.Source.BufferSize)
+				archive = bw
+			}
 
-							if err := sourceFile.Close(); err != nil {
-								return fmt.Errorf("close file: %w", err)
-							}
+			a, err := writeSourceArchive(ctx, logger, archive, names, flags.Source.Compression, flags.Source.CompressionLevel, sourceArchiveOptions{
+				stripComponents: flags.Source.StripComponents,
+				relativeTo:      flags.Source.RelativeTo,
+				strictRelative:  flags.Source.StrictRelative,
+				buildID:         buildID,
+				maxFiles:        flags.Source.MaxSourceFiles,
+				originalPaths:   originalPaths,
+				debuginfod:      debuginfod,
+				cache:           cache,
+			})
+			if err != nil {
+				return err
+			}
+			if bw != nil {
+				if err := bw.Flush(); err != nil {
+					return fmt.Errorf("write source archive: %w", err)
+				}
+			}
 
-							seen[lineFile.Name] = struct{}{}
-						}
-					}
+			if flags.Source.Manifest != "" {
+				if err := writeSourceManifest(flags.Source.Manifest, a); err != nil {
+					return err
 				}
 			}
 
-			return nil
+			if upload == nil {
+				return nil
+			}
+			upload.size = int64(buf.Len())
+			buf.SeekStart()
+			upload.reader = buf
+
+			errs = append(errs, uploadToStores(ctx, flags, pending, upload))
+			return errors.Join(errs...)
 		}, func(error) {
 			cancel()
 		})
 
-	default:
-		cancel()
-		return errors.New("unknown command: " + kongCtx.Command())
-	}
+	case "decompress <path>":
+		tmps := &tempFiles{}
+		g.Add(func() error {
+			output := flags.Decompress.Output
+			if output == "" {
+				output = flags.Decompress.Path + ".decompressed"
+			}
+
+			f, err := os.Open(flags.Decompress.Path)
+			if err != nil {
+				return fmt.Errorf("open file: %w", err)
+			}
+			defer f.Close()
+
+			n, err := decompressSections(f, output, tmps)
+			if err != nil {
+				return fmt.Errorf("decompress %q: %w", flags.Decompress.Path, err)
+			}
+			infof(flags, "Decompressed %d sections of %q to %q", n, flags.Decompress.Path, output)
+			return nil
+		}, func(error) {
+			cancel()
+			tmps.removeAll()
+		})
+
+	case "info <path>":
+		cancel()
+		info, err := getDebuginfoSummary(flags.Info.Path)
+		if err != nil {
+			return err
+		}
+		if flags.Info.Output == "json" {
+			return json.NewEncoder(os.Stdout).Encode(info)
+		}
+		return info.print(os.Stdout)
+
+	case "symbolize <debuginfo-path> <address>":
+		cancel()
+		pc, err := parseAddress(flags.Symbolize.Address)
+		if err != nil {
+			return err
+		}
+		res, err := symbolize(flags.Symbolize.DebuginfoPath, pc)
+		if err != nil {
+			return err
+		}
+		if flags.Symbolize.Output == "json" {
+			return json.NewEncoder(os.Stdout).Encode(res)
+		}
+		return res.print(os.Stdout)
+
+	case "status <path>":
+		g.Add(func() error {
+			clients, err := newStoreClients(ctx, flags.Status.storeFlags, 1, uploadOptions{})
+			if err != nil {
+				return err
+			}
+			defer closeStoreClients(clients)
+
+			// Files are resolved like for upload, which reads the
+			// Build ID from the upload flags.
+			flags.Upload.BuildID = flags.Status.BuildID
+			var uploads []*uploadInfo
+			for _, arg := range flags.Status.Paths {
+				path, typ := splitPathType(arg, flags.Status.Type)
+				pathUploads, err := resolveUploads(logger, flags, path, typ)
+				if err != nil {
+					return err
+				}
+				uploads = append(uploads, pathUploads...)
+			}
+
+			statuses, err := uploadStatuses(ctx, clients, uploads)
+			if flags.Status.Output == "json" {
+				enc := json.NewEncoder(os.Stdout)
+				for _, s := range statuses {
+					if err := enc.Encode(s); err != nil {
+						return err
+					}
+				}
+			} else if err := printUploadStatuses(os.Stdout, statuses); err != nil {
+				return err
+			}
+			return err
+		}, func(error) {
+			cancel()
+		})
+
+	case "selftest":
+		g.Add(func() error {
+			return runSelftest(ctx, logger, flags, os.Stdout)
+		}, func(error) {
+			cancel()
+		})
+
+	case "ping":
+		g.Add(func() error {
+			stores, err := storesFromFlags(flags.Ping.storeFlags)
+			if err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, s := range stores {
+				res := pingStore(ctx, flags.Ping.storeFlags, s)
+				res.print(os.Stdout, flags.Ping.Output)
+				if !res.OK {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d stores failed the check", failed, len(stores))
+			}
+			return nil
+		}, func(error) {
+			cancel()
+		})
+
+	case "version":
+		cancel()
+		bi := getBuildInfo()
+		if flags.VersionCmd.Output == "json" {
+			return json.NewEncoder(os.Stdout).Encode(bi)
+		}
+		fmt.Fprintln(os.Stdout, bi.String())
+		return nil
+
+	case "schema":
+		cancel()
+		return writeSchema(os.Stdout, kongCtx.Model)
+
+	default:
+		cancel()
+		return errors.New("unknown command: " + kongCtx.Command())
+	}
 
 	g.Add(grun.SignalHandler(ctx, os.Interrupt, os.Kill))
 	return g.Run()
 }
 
-func grpcConn(reg prometheus.Registerer, flags flags) (*grpc.ClientConn, error) {
+// writeSourceManifest writes the status of every source file referenced by
+// the archive to path.
+func writeSourceManifest(path string, a *sourceArchiver) error {
+	mf, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create manifest: %w", err)
+	}
+	defer mf.Close()
+
+	if err := a.writeReport(mf); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return mf.Close()
+}
+
+// resolveUploads returns what to upload for the file at path as the given
+// --type. Multi-architecture files are uploaded once per architecture, each
+// with its own Build ID.
+func resolveUploads(logger log.Logger, flags flags, path, typeName string) ([]*uploadInfo, error) {
+	if typeName != "sources" {
+		parts, skipped, err := containerSlices(path)
+		if err != nil {
+			return nil, fmt.Errorf("read %q: %w", path, err)
+		}
+		for _, name := range skipped {
+			level.Warn(logger).Log("msg", "skipping compressed native library, only uncompressed ones can be uploaded", "path", path, "library", name)
+		}
+		if len(parts) > 0 || len(skipped) > 0 {
+			return sliceUploads(flags, path, typeName, parts)
+		}
+	}
+
+	typ, err := uploadType(typeName, path)
+	if err != nil {
+		return nil, fmt.Errorf("infer type of %q: %w", path, err)
+	}
+	if typ == debuginfopb.DebuginfoType_DEBUGINFO_TYPE_SOURCES && !flags.Upload.SkipArchiveValidation {
+		if err := validateSourceArchive(path); err != nil {
+			return nil, fmt.Errorf("invalid source archive %q, pass --skip-archive-validation to upload it anyway: %w", path, err)
+		}
+	}
+
+	var arch string
+	if typ != debuginfopb.DebuginfoType_DEBUGINFO_TYPE_SOURCES {
+		arch = fileArch(path)
+	}
+	if arch != "" && len(flags.Upload.Arch) > 0 && !slices.Contains(flags.Upload.Arch, arch) {
+		infof(flags, "Skipping upload of %q as its architecture %s is not in --arch", path, arch)
+		return nil, nil
+	}
+
+	buildID, synthesized, err := uploadBuildID(flags, path, typ)
+	if err != nil {
+		return nil, fmt.Errorf("get Build ID for %q: %w", path, err)
+	}
+
+	if err := validateBuildID(flags, buildID); err != nil {
+		return nil, fmt.Errorf("invalid Build ID for %q: %w", path, err)
+	}
+
+	return []*uploadInfo{{
+		path:               path,
+		buildID:            buildID,
+		synthesizedBuildID: synthesized != "",
+		typ:                typ,
+		arch:               arch,
+	}}, nil
+}
+
+// fileArch returns the architecture of the file at path if it is an ELF file,
+// and an empty string otherwise.
+func fileArch(path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return elfArch(f)
+}
+
+// sliceUploads returns the uploads for the slices of the multi-architecture
+// file at path that match --arch.
+func sliceUploads(flags flags, path, typeName string, parts []containerSlice) ([]*uploadInfo, error) {
+	if flags.Upload.BuildID != "" {
+		return nil, fmt.Errorf("--build-id cannot be used with the multi-architecture file %q, every architecture is uploaded with its own Build ID", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	uploads := make([]*uploadInfo, 0, len(parts))
+	for _, s := range parts {
+		if len(flags.Upload.Arch) > 0 && !slices.Contains(flags.Upload.Arch, s.arch) {
+			infof(flags, "Skipping upload of %q as its architecture %s is not in --arch", s.name, s.arch)
+			continue
+		}
+
+		typ := debuginfoTypeStringToPb(typeName)
+		if typeName == "auto" {
+			typ, err = s.debuginfoType(f)
+			if err != nil {
+				return nil, fmt.Errorf("infer type of %q: %w", s.name, err)
+			}
+		}
+
+		buildID, err := s.buildID(f, flags.BuildIDFrom)
+		if err != nil {
+			return nil, fmt.Errorf("get Build ID for %q: %w", s.name, err)
+		}
+
+		if err := validateBuildID(flags, buildID); err != nil {
+			return nil, fmt.Errorf("invalid Build ID for %q: %w", s.name, err)
+		}
+
+		uploads = append(uploads, &uploadInfo{
+			path:    s.name,
+			buildID: buildID,
+			typ:     typ,
+			arch:    s.arch,
+			slice:   &s,
+		})
+	}
+	return uploads, nil
+}
+
+// modifiedSince reports whether the file at path was modified at or after t.
+func modifiedSince(path string, t time.Time) (bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return !fi.ModTime().Before(t), nil
+}
+
+// uploadBuildID returns the Build ID to upload the file at path with, and
+// also as synthesized if it was synthesized with --synthesize-build-id.
+func uploadBuildID(flags flags, path string, typ debuginfopb.DebuginfoType) (string, string, error) {
+	if !flags.Upload.NoExtract && typ == debuginfopb.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED {
+		ef, err := elf.Open(path)
+		if err != nil {
+			return "", "", fmt.Errorf("open ELF file: %w", err)
+		}
+		defer ef.Close()
+
+		return getExtractBuildID(ef, flags.BuildIDFrom, flags.Upload.extractFlags)
+	}
+
+	if flags.Upload.BuildID == "" && typ != debuginfopb.DebuginfoType_DEBUGINFO_TYPE_SOURCES {
+		buildID, err := getFileBuildID(path, flags.BuildIDFrom)
+		if errors.Is(err, ErrNoBuildID) && typ == debuginfopb.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED {
+			return "", "", noBuildIDError(path)
+		}
+		return buildID, "", err
+	}
+	return flags.Upload.BuildID, "", nil
+}
+
+// filterUploads applies the --skip-build-id and --only-build-id filters, and
+// skips the Build IDs uploaded by previous runs, if seen is set.
+func filterUploads(flags flags, seen *seenBuildIDs, uploads []*uploadInfo) []*uploadInfo {
+	filtered := make([]*uploadInfo, 0, len(uploads))
+	for _, upload := range uploads {
+		if slices.Contains(flags.Upload.SkipBuildID, upload.buildID) {
+			infof(flags, "Skipping upload of %q with Build ID %q as requested by --skip-build-id", upload.path, upload.buildID)
+			continue
+		}
+		if len(flags.Upload.OnlyBuildID) > 0 && !slices.Contains(flags.Upload.OnlyBuildID, upload.buildID) {
+			infof(flags, "Skipping upload of %q with Build ID %q as it is not in --only-build-id", upload.path, upload.buildID)
+			continue
+		}
+		if seen != nil && !flags.Upload.Force && seen.contains(upload.buildID, upload.typ) {
+			infof(flags, "Skipping upload of %q with Build ID %q as it was already uploaded according to --seen-build-ids-file", upload.path, upload.buildID)
+			continue
+		}
+		filtered = append(filtered, upload)
+	}
+	return filtered
+}
+
+// uploadFile uploads a file to the stores that want it. Extractions reserve
+// the memory they may buffer from inflight, if set, until the upload is done.
+func uploadFile(ctx context.Context, logger log.Logger, flags flags, clients []*storeClient, inflight *semaphore.Weighted, upload *uploadInfo) error {
+	start := time.Now()
+	defer func() { upload.timings.total = time.Since(start) }()
+
+	// The stores are asked for the original file instead, so that it is
+	// uploaded as is.
+	if upload.noDWARF && flags.Upload.FallbackUploadOriginal && upload.extracts(flags) {
+		level.Warn(logger).Log("msg", "binary has no DWARF, uploading the original file as executable instead", "path", upload.path, "build_id", upload.buildID)
+		upload.typ = debuginfopb.DebuginfoType_DEBUGINFO_TYPE_EXECUTABLE
+	}
+
+	// Extracting debug information is expensive, so ask the stores first and
+	// only extract if at least one of them wants the file.
+	pending, err := pendingStores(ctx, flags, clients, upload)
+	for _, skip := range upload.skipped {
+		level.Info(logger).Log("msg", "store skipped upload", "path", upload.path, "build_id", upload.buildID, "store", skip.Store, "reason", skip.Reason)
+	}
+	if len(pending) == 0 {
+		return err
+	}
+	errs := []error{err}
+
+	f, err := upload.open()
+	if err != nil {
+		// The stores that could not be asked are reported as well.
+		return errors.Join(append(errs, err)...)
+	}
+	defer f.Close()
+
+	if upload.extracts(flags) {
+		if inflight != nil {
+			n := inflightBytes(flags, f.Size())
+			verbosef(flags, "Reserving %s of memory to extract %q", formatSize(flags, n), upload.path)
+			if err := inflight.Acquire(ctx, n); err != nil {
+				return err
+			}
+			defer inflight.Release(n)
+		}
+
+		verbosef(flags, "Extracting debug information from %q", upload.path)
+		extractStart := time.Now()
+		buf := newSpillBuffer(flags.Upload.SpillThreshold)
+		defer buf.Close()
+		var synthesized string
+		if upload.synthesizedBuildID {
+			synthesized = upload.buildID
+		}
+		if err := extractDebugInfo(logger, buf, f, flags.Upload.extractFlags, synthesized, flags.Upload.SpillThreshold); err != nil {
+			return fmt.Errorf("failed to extract debug information: %w", err)
+		}
+		if err := verifyExtractedBuildID(buf, upload.buildID, flags.BuildIDFrom); err != nil {
+			return fmt.Errorf("verify debug information extracted from %q: %w", upload.path, err)
+		}
+		upload.timings.extract = time.Since(extractStart)
+
+		if flags.Upload.PostExtractHook != "" {
+			verbosef(flags, "Running post-extract hook on %q", upload.path)
+			size, err := buf.Size()
+			if err != nil {
+				return err
+			}
+			out, err := runPostExtractHook(ctx, flags.Upload.PostExtractHook, flags.Upload.PostExtractHookReplace, flags.Upload.SpillThreshold, upload, buf, size)
+			if err != nil {
+				return err
+			}
+			if out != nil {
+				defer out.Close()
+				buf = out
+			}
+		}
+
+		upload.size, err = buf.Size()
+		if err != nil {
+			return err
+		}
+		if _, err := buf.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek to start of extracted debug information: %w", err)
+		}
+		upload.reader = buf
+
+		level.Info(logger).Log(
+			"msg", "extracted debug information",
+			"path", upload.path,
+			"build_id", upload.buildID,
+			"arch", upload.arch,
+			"original_size", formatSize(flags, f.Size()),
+			"extracted_size", formatSize(flags, upload.size),
+			"ratio", fmt.Sprintf("%.3f", float64(upload.size)/float64(f.Size())),
+		)
+	}
+	// The file was not extracted, or is uploaded as fallback.
+	if upload.reader == nil {
+		if f.Size() == 0 {
+			return fmt.Errorf("file %q is empty, but must not be empty", upload.path)
+		}
+		upload.reader = f
+		upload.size = f.Size()
+	}
+
+	errs = append(errs, uploadToStores(ctx, flags, pending, upload))
+	return errors.Join(errs...)
+}
+
+// hasSources reports whether source files can be discovered from the file for
+// --with-sources, which requires an ELF file uploaded as debuginfo.
+func (u *uploadInfo) hasSources() bool {
+	isMachO := u.slice != nil && u.slice.macho
+	return !isMachO && u.typ == debuginfopb.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED
+}
+
+// uploadSources uploads an archive of the source files referenced by the DWARF
+// line tables of the file as its sources, if any of the stores want them.
+func uploadSources(ctx context.Context, logger log.Logger, flags flags, clients []*storeClient, upload *uploadInfo) error {
+	sources := &uploadInfo{
+		path:    "sources of " + upload.path,
+		buildID: upload.buildID,
+		typ:     debuginfopb.DebuginfoType_DEBUGINFO_TYPE_SOURCES,
+	}
+	pending, err := pendingStores(ctx, flags, clients, sources)
+	if len(pending) == 0 {
+		return err
+	}
+	errs := []error{err}
+
+	f, err := upload.open()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	defer f.Close()
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return fmt.Errorf("open ELF file: %w", err)
+	}
+	defer ef.Close()
+
+	d, err := openDWARF(ef)
+	if err != nil {
+		return fmt.Errorf("get dwarf data of %q: %w", upload.path, err)
+	}
+	names, err := sourceFileNames(ctx, logger, nil, d)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		infof(flags, "Skipping upload of %s as its DWARF references no source files", sources.path)
+		return errors.Join(errs...)
+	}
+
+	verbosef(flags, "Archiving %d source files of %q", len(names), upload.path)
+	buf := &flexbuf.Buffer{}
+	if _, err := writeSourceArchive(ctx, logger, buf, names, "zstd", defaultSourceCompressionLevel, sourceArchiveOptions{
+		buildID: upload.buildID,
+	}); err != nil {
+		return fmt.Errorf("archive sources of %q: %w", upload.path, err)
+	}
+	sources.size = int64(buf.Len())
+	buf.SeekStart()
+	sources.reader = buf
+
+	errs = append(errs, uploadToStores(ctx, flags, pending, sources))
+	return errors.Join(errs...)
+}
+
+// inflightBytes returns how many bytes extracting a file of size bytes may
+// buffer in memory. Extracted debug information is at most as large as the
+// file, and spill buffers hold at most --spill-threshold bytes in memory. A
+// file larger than --max-inflight-bytes reserves all of it, so that it is
+// extracted on its own.
+func inflightBytes(flags flags, size int64) int64 {
+	n := min(size, flags.Upload.SpillThreshold)
+	if flags.Upload.PostExtractHookReplace || flags.Upload.SynthesizeBuildID {
+		// The output of the hook is buffered as well, and so is the
+		// debug information before a synthesized Build ID note is
+		// added. The latter buffer is released before the hook runs.
+		n *= 2
+	}
+	return min(n, flags.Upload.MaxInflightBytes)
+}
+
+// pendingStores returns the clients of the stores that want the file to be
+// uploaded, and the errors of the stores that could not be asked.
+func pendingStores(ctx context.Context, flags flags, clients []*storeClient, upload *uploadInfo) ([]*storeClient, error) {
+	var (
+		errs    []error
+		pending []*storeClient
+	)
+	for _, c := range clients {
+		verbosef(flags, "Checking whether %s wants %q with Build ID %q", c.address, upload.path, upload.buildID)
+		ok, err := c.shouldInitiate(ctx, flags, upload)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("store %s: %w", c.address, err))
+			continue
+		}
+		if ok {
+			pending = append(pending, c)
+		}
+	}
+	return pending, errors.Join(errs...)
+}
+
+// uploadToStores uploads the prepared file to the given stores.
+func uploadToStores(ctx context.Context, flags flags, clients []*storeClient, upload *uploadInfo) error {
+	// Failing to upload to one store must not prevent uploading to the others.
+	var errs []error
+	for _, c := range clients {
+		if err := c.upload(ctx, flags, upload); err != nil {
+			errs = append(errs, fmt.Errorf("store %s: %w", c.address, err))
+			continue
+		}
+		upload.uploaded++
+	}
+	return errors.Join(errs...)
+}
+
+// uploadInfo describes a file to be uploaded to one or more stores.
+type uploadInfo struct {
+	path    string
+	buildID string
+	typ     debuginfopb.DebuginfoType
+	// arch is the architecture of ELF files and slices, if known.
+	arch string
+	// slice is set if the file is one architecture of a multi-architecture
+	// file, path is then the name it is reported as.
+	slice  *containerSlice
+	reader io.ReadSeeker
+	size   int64
+	// noDWARF is set if debug information is extracted from the file, but it
+	// has no DWARF.
+	noDWARF bool
+	// synthesizedBuildID is set if the ELF file has no Build ID note and
+	// buildID was synthesized for it with --synthesize-build-id.
+	synthesizedBuildID bool
+
+	// contentHash is computed on first use and shared across stores.
+	contentHash string
+
+	// uploaded counts the stores the file was uploaded to, skipped records
+	// the stores that did not want it.
+	uploaded int
+	skipped  []uploadSkip
+	// unfinished records the uploads that could not be marked as finished.
+	unfinished []unfinishedUpload
+	// finishedAt is set once the file was processed for every store without
+	// error.
+	finishedAt time.Time
+
+	timings uploadTimings
+}
+
+// extracts reports whether debug information is extracted from the file
+// before uploading it. Only ELF files can be extracted, Mach-O slices are
+// uploaded as is.
+func (u *uploadInfo) extracts(flags flags) bool {
+	isMachO := u.slice != nil && u.slice.macho
+	return !flags.Upload.NoExtract && !isMachO && u.typ == debuginfopb.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED
+}
+
+// hasDWARF reports whether the file is an ELF file with DWARF.
+func (u *uploadInfo) hasDWARF() (bool, error) {
+	f, err := u.open()
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return false, fmt.Errorf("open ELF file: %w", err)
+	}
+	defer ef.Close()
+	return hasDWARFSections(ef), nil
+}
+
+// checkDWARF warns about the uploads debug information is extracted from, but
+// that have no DWARF, so that only their symbol tables are uploaded. With
+// --require-dwarf it fails instead, before anything is uploaded.
+func checkDWARF(logger log.Logger, flags flags, uploads []*uploadInfo) error {
+	var errs []error
+	for _, upload := range uploads {
+		if !upload.extracts(flags) {
+			continue
+		}
+		ok, err := upload.hasDWARF()
+		if err != nil || ok {
+			// Files that cannot be read fail when they are uploaded.
+			continue
+		}
+		upload.noDWARF = true
+		if flags.Upload.RequireDwarf {
+			errs = append(errs, fmt.Errorf("%q with Build ID %q: %w", upload.path, upload.buildID, errNoDWARF))
+			continue
+		}
+		if flags.Upload.FallbackUploadOriginal {
+			// uploadFile warns about the fallback.
+			continue
+		}
+		level.Warn(logger).Log("msg", errNoDWARF.Error()+" Only its symbol tables are uploaded.", "path", upload.path, "build_id", upload.buildID)
+	}
+	return errors.Join(errs...)
+}
+
+// uploadSkip is a store's reason for not wanting a file.
+type uploadSkip struct {
+	Store  string `json:"store"`
+	Reason string `json:"reason"`
+}
+
+// uploadTimings records how long the phases of uploading a file took. The
+// upload phase is summed up over all stores.
+type uploadTimings struct {
+	extract time.Duration
+	hash    time.Duration
+	upload  time.Duration
+	total   time.Duration
+}
+
+// reportTimings prints the timings of an upload if requested.
+func reportTimings(flags flags, upload *uploadInfo, err error) {
+	t := upload.timings
+	switch {
+	case flags.Upload.Output == "json":
+		res := struct {
+			Path      string       `json:"path"`
+			BuildID   string       `json:"build_id"`
+			Arch      string       `json:"arch,omitempty"`
+			ExtractMs int64        `json:"extract_ms"`
+			HashMs    int64        `json:"hash_ms"`
+			UploadMs  int64        `json:"upload_ms"`
+			TotalMs   int64        `json:"total_ms"`
+			Uploaded  int          `json:"uploaded"`
+			Skipped   []uploadSkip `json:"skipped,omitempty"`
+			Error     string       `json:"error,omitempty"`
+		}{
+			Path:      upload.path,
+			BuildID:   upload.buildID,
+			Arch:      upload.arch,
+			ExtractMs: t.extract.Milliseconds(),
+			HashMs:    t.hash.Milliseconds(),
+			UploadMs:  t.upload.Milliseconds(),
+			TotalMs:   t.total.Milliseconds(),
+			Uploaded:  upload.uploaded,
+			Skipped:   upload.skipped,
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		// Failing to write to stdout is not worth failing the upload for.
+		_ = json.NewEncoder(os.Stdout).Encode(res)
+	case flags.Upload.Timings:
+		fmt.Fprintf(os.Stdout, "Timings of %q: extract %s, hash %s, upload %s, total %s\n", upload.path, t.extract, t.hash, t.upload, t.total)
+	}
+}
+
+// printInterruptSummary prints which of the uploads finished before the
+// command was interrupted and which are still pending, so that only the
+// pending files need to be uploaded again.
+func printInterruptSummary(w io.Writer, uploads []*uploadInfo) {
+	var finished, pending []*uploadInfo
+	for _, u := range uploads {
+		if !u.finishedAt.IsZero() {
+			finished = append(finished, u)
+		} else {
+			pending = append(pending, u)
+		}
+	}
+
+	fmt.Fprintf(w, "Interrupted, %d of %d files finished:\n", len(finished), len(uploads))
+	for _, u := range finished {
+		fmt.Fprintf(w, "  finished %s (Build ID %s)\n", u.path, u.buildID)
+	}
+	for _, u := range pending {
+		fmt.Fprintf(w, "  pending  %s (Build ID %s)\n", u.path, u.buildID)
+	}
+}
+
+func (u *uploadInfo) hash() (string, error) {
+	if u.contentHash != "" {
+		return u.contentHash, nil
+	}
+
+	if _, err := u.reader.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("seek to start of %q with Build ID %q: %w", u.path, u.buildID, err)
+	}
+	start := time.Now()
+	h, err := hash.Reader(u.reader)
+	if err != nil {
+		return "", fmt.Errorf("calculate hash of %q with Build ID %q: %w", u.path, u.buildID, err)
+	}
+	u.timings.hash = time.Since(start)
+	u.contentHash = h
+	return h, nil
+}
+
+// verifyHash compares the hash of the uploaded content with the one sent to
+// the store, to detect the content having changed since the latter was
+// calculated.
+func (u *uploadInfo) verifyHash(sent *xxhash.Digest) error {
+	if h := hex.EncodeToString(sent.Sum(nil)); h != u.contentHash {
+		return fmt.Errorf("content of %q with Build ID %q changed during upload: hash is %s, but %s was sent to the store", u.path, u.buildID, h, u.contentHash)
+	}
+	return nil
+}
+
+// storeClient is a connection to a single store.
+type storeClient struct {
+	address string
+	conns   []*storeConn
+	opts    uploadOptions
+	// httpClient performs uploads to signed URLs.
+	httpClient *http.Client
+	// disabledStrategies are the upload strategies not to perform.
+	disabledStrategies []string
+	// multipartThreshold is the largest size uploaded to signed URLs, if set.
+	multipartThreshold int64
+	// limiter limits the rate of uploads, if set.
+	limiter *rate.Limiter
+
+	mu   sync.Mutex
+	next int
+	// compressionUnsupported is set once the store rejected a compressed
+	// upload.
+	compressionUnsupported bool
+}
+
+// storeConn is a single gRPC connection to a store.
+type storeConn struct {
+	// conn is nil for local stores.
+	conn             *grpc.ClientConn
+	debuginfoClient  debuginfopb.DebuginfoServiceClient
+	grpcUploadClient *parcadebuginfo.GrpcUploadClient
+	// compressedUploadClient is only set if compression is enabled.
+	compressedUploadClient *parcadebuginfo.GrpcUploadClient
+}
+
+// uploadOptions control the upload protocol with a store.
+type uploadOptions struct {
+	markFinishedRetries   int
+	shouldInitiateRetries int
+	force                 bool
+	noInitiate            bool
+	skipHash              bool
+	verifyLocalHash       bool
+}
+
+// newStoreClients creates a client for every store configured by sf, each
+// with poolSize connections.
+func newStoreClients(ctx context.Context, sf storeFlags, poolSize int, opts uploadOptions) ([]*storeClient, error) {
+	stores, err := storesFromFlags(sf)
+	if err != nil {
+		return nil, err
+	}
+	if sf.RateLimit < 0 {
+		return nil, errors.New("--rate-limit must not be negative")
+	}
+	// A single limiter is shared by all stores, so that the limit applies
+	// to the total upload rate.
+	var limiter *rate.Limiter
+	if sf.RateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(sf.RateLimit), int(sf.RateLimit))
+	}
+
+	clients := make([]*storeClient, 0, len(stores))
+	for _, s := range stores {
+		c, err := newStoreClient(ctx, sf, s, poolSize, opts)
+		if err != nil {
+			closeStoreClients(clients)
+			return nil, fmt.Errorf("store %s: %w", s.address, err)
+		}
+		c.limiter = limiter
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+func closeStoreClients(clients []*storeClient) {
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func newStoreClient(ctx context.Context, sf storeFlags, s store, poolSize int, opts uploadOptions) (*storeClient, error) {
+	c := &storeClient{address: s.address, opts: opts, httpClient: signedURLClient(sf), disabledStrategies: sf.DisableStrategy, multipartThreshold: sf.MultipartThreshold}
+	if dir, ok := localStoreDir(s.address); ok {
+		ls, err := newLocalStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		c.conns = []*storeConn{{
+			debuginfoClient:  ls,
+			grpcUploadClient: parcadebuginfo.NewGrpcUploadClient(ls),
+		}}
+		return c, nil
+	}
+	for range poolSize {
+		conn, err := grpcConn(prometheus.NewRegistry(), sf, s)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if sf.GrpcConnectTimeout > 0 {
+			if err := waitForReady(ctx, conn, sf.GrpcConnectTimeout); err != nil {
+				conn.Close()
+				c.Close()
+				return nil, err
+			}
+		}
+
+		debuginfoClient := debuginfopb.NewDebuginfoServiceClient(conn)
+		sc := &storeConn{
+			conn:            conn,
+			debuginfoClient: debuginfoClient,
+			grpcUploadClient: parcadebuginfo.NewGrpcUploadClient(&uploadServiceClient{
+				DebuginfoServiceClient: debuginfoClient,
+				opts:                   grpcCallOptions(sf),
+				chunkSize:              sf.GrpcChunkSize,
+			}),
+		}
+		if sf.GrpcCompression != "none" {
+			sc.compressedUploadClient = parcadebuginfo.NewGrpcUploadClient(&uploadServiceClient{
+				DebuginfoServiceClient: debuginfoClient,
+				opts:                   append(grpcCallOptions(sf), grpc.UseCompressor(sf.GrpcCompression)),
+				chunkSize:              sf.GrpcChunkSize,
+			})
+		}
+		c.conns = append(c.conns, sc)
+	}
+	return c, nil
+}
+
+func (c *storeClient) Close() error {
+	var errs []error
+	for _, conn := range c.conns {
+		// Local stores have no connection.
+		if conn.conn != nil {
+			errs = append(errs, conn.conn.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pick returns the next connection of the pool in round-robin order.
+func (c *storeClient) pick() *storeConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn := c.conns[c.next]
+	c.next = (c.next + 1) % len(c.conns)
+	return conn
+}
+
+// shouldInitiate asks the store whether it wants the file to be uploaded.
+func (c *storeClient) shouldInitiate(ctx context.Context, flags flags, upload *uploadInfo) (bool, error) {
+	shouldInitiate, err := c.shouldInitiateUpload(ctx, flags, &debuginfopb.ShouldInitiateUploadRequest{
+		BuildId: upload.buildID,
+		Force:   c.opts.force,
+		Type:    upload.typ,
+	})
+	if status.Code(err) == codes.Unavailable {
+		return false, fmt.Errorf("cannot connect to store at %s: %w", c.address, err)
+	}
+	if err != nil {
+		return false, fmt.Errorf("check if upload should be initiated for %q with Build ID %q: %w", upload.path, upload.buildID, err)
+	}
+	if !shouldInitiate.GetShouldInitiateUpload() {
+		upload.skipped = append(upload.skipped, uploadSkip{Store: c.address, Reason: shouldInitiate.GetReason()})
+		infof(flags, "Skipping upload of %q with Build ID %q to %s as the store instructed not to: %s", upload.path, upload.buildID, c.address, shouldInitiate.GetReason())
+		return false, nil
+	}
+
+	if c.opts.noInitiate {
+		infof(flags, "Not initiating upload of %q with Build ID %q to %s as requested, but would have requested that next, because: %s", upload.path, upload.buildID, c.address, shouldInitiate.GetReason())
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// shouldInitiateUpload asks the store whether it wants a file, retrying up to
+// --should-initiate-retries times if the store is unavailable or does not
+// answer in time. The request does not change anything, so it is always safe
+// to retry.
+func (c *storeClient) shouldInitiateUpload(ctx context.Context, flags flags, req *debuginfopb.ShouldInitiateUploadRequest) (*debuginfopb.ShouldInitiateUploadResponse, error) {
+	backoff := shouldInitiateBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.pick().debuginfoClient.ShouldInitiateUpload(ctx, req)
+		code := status.Code(err)
+		if err == nil || attempt >= c.opts.shouldInitiateRetries || (code != codes.Unavailable && code != codes.DeadlineExceeded) {
+			return resp, err
+		}
+
+		verbosef(flags, "Asking %s whether to upload Build ID %q failed, retrying in %s: %v", c.address, req.GetBuildId(), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return resp, err
+		}
+		backoff *= 2
+	}
+}
+
+// upload runs the remainder of the upload protocol for a file the store asked for.
+func (c *storeClient) upload(ctx context.Context, flags flags, upload *uploadInfo) error {
+	conn := c.pick()
+
+	// With --skip-hash an empty hash is sent, which stores treat as unknown.
+	var hash string
+	if !c.opts.skipHash {
+		verbosef(flags, "Hashing %q", upload.path)
+		var err error
+		hash, err = upload.hash()
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := upload.reader.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("seek to start of %q with Build ID %q: %w", upload.path, upload.buildID, err)
+	}
+
+	// With --verify-local-hash the content is hashed again while it is
+	// uploaded instead of reading it another time afterwards. Stores only
+	// take the hash when initiating the upload, so it cannot be skipped
+	// upfront.
+	var sent *xxhash.Digest
+	if c.opts.verifyLocalHash {
+		sent = xxhash.New()
+	}
+
+	start := time.Now()
+	defer func() { upload.timings.upload += time.Since(start) }()
+
+	verbosef(flags, "Initiating upload of %q with Build ID %q to %s", upload.path, upload.buildID, c.address)
+	initiationResp, err := conn.debuginfoClient.InitiateUpload(ctx, &debuginfopb.InitiateUploadRequest{
+		BuildId: upload.buildID,
+		Hash:    hash,
+		Size:    upload.size,
+		Force:   c.opts.force,
+		Type:    upload.typ,
+	})
+	if err != nil {
+		return fmt.Errorf("initiate upload for %q with Build ID %q: %w", upload.path, upload.buildID, err)
+	}
+
+	verbosef(flags, "Upload instructions\nBuildID: %s\nUploadID: %s\nUploadStrategy: %s\nSignedURL: %s\nType: %s", initiationResp.GetUploadInstructions().GetBuildId(), initiationResp.GetUploadInstructions().GetUploadId(), initiationResp.GetUploadInstructions().GetUploadStrategy().String(), initiationResp.GetUploadInstructions().GetSignedUrl(), initiationResp.GetUploadInstructions().GetType())
+
+	// The request has no field to express a preference, so all that can be
+	// done is to fail before transferring anything.
+	if strategy := uploadStrategyName(initiationResp.GetUploadInstructions().GetUploadStrategy()); slices.Contains(c.disabledStrategies, strategy) {
+		return fmt.Errorf("store asked to upload %q with Build ID %q via %s, which is disabled by --disable-strategy", upload.path, upload.buildID, strategy)
+	}
+	if initiationResp.GetUploadInstructions().GetUploadStrategy() == debuginfopb.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL && c.multipartThreshold > 0 && upload.size > c.multipartThreshold {
+		return fmt.Errorf("store asked to upload %q with Build ID %q of %d bytes via signed URL, which needs a multipart upload above --multipart-threshold of %d bytes, but the debuginfo API provides no part URLs", upload.path, upload.buildID, upload.size, c.multipartThreshold)
+	}
+
+	switch initiationResp.GetUploadInstructions().GetUploadStrategy() {
+	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_GRPC:
+		verbosef(flags, "Performing a gRPC upload of %q with Build ID %q to %s", upload.path, upload.buildID, c.address)
+		err = c.grpcUpload(ctx, flags, conn, initiationResp.GetUploadInstructions(), upload, sent)
+	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL:
+		verbosef(flags, "Performing a signed URL upload of %q with Build ID %q to %s", upload.path, upload.buildID, c.address)
+		err = uploadViaSignedURL(ctx, c.httpClient, initiationResp.GetUploadInstructions().GetSignedUrl(), c.reader(ctx, upload, sent), upload.size)
+	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_UNSPECIFIED:
+		err = errors.New("no upload strategy specified")
+	default:
+		err = fmt.Errorf("unknown upload strategy: %v", initiationResp.GetUploadInstructions().GetUploadStrategy())
+	}
+	if err != nil {
+		return fmt.Errorf("upload %q with Build ID %q: %w", upload.path, upload.buildID, err)
+	}
+
+	// Do not mark the upload as finished if different content than the
+	// hashed one may have been sent.
+	if sent != nil {
+		verbosef(flags, "Verifying hash of %q", upload.path)
+		if err := upload.verifyHash(sent); err != nil {
+			return err
+		}
+	}
+
+	// The file was transferred at this point, so finishing is retried on
+	// its own and failures are recorded for --resume-file.
+	verbosef(flags, "Marking upload of %q with Build ID %q to %s as finished", upload.path, upload.buildID, c.address)
+	finish := unfinishedUpload{
+		Store:    c.address,
+		BuildID:  upload.buildID,
+		UploadID: initiationResp.GetUploadInstructions().GetUploadId(),
+		Type:     upload.typ.String(),
+	}
+	if err := c.markFinished(ctx, flags, finish); err != nil {
+		upload.unfinished = append(upload.unfinished, finish)
+		return fmt.Errorf("mark upload finished for %q with Build ID %q: %w", upload.path, upload.buildID, err)
+	}
+
+	infof(flags, "Uploaded %q with Build ID %q to %s", upload.path, upload.buildID, c.address)
+	return nil
+}
+
+// grpcUpload uploads the file with the gRPC upload strategy. gRPC does not
+// negotiate compression, so if the store rejects a compressed upload it is
+// retried uncompressed, and compression stays disabled for the store.
+func (c *storeClient) grpcUpload(ctx context.Context, flags flags, conn *storeConn, instructions *debuginfopb.UploadInstructions, upload *uploadInfo, sent *xxhash.Digest) error {
+	c.mu.Lock()
+	compress := conn.compressedUploadClient != nil && !c.compressionUnsupported
+	c.mu.Unlock()
+
+	if compress {
+		_, err := conn.compressedUploadClient.Upload(ctx, instructions, c.reader(ctx, upload, sent))
+		if status.Code(err) != codes.Unimplemented {
+			return err
+		}
+
+		verbosef(flags, "%s does not support compressed uploads, retrying upload of %q uncompressed: %v", c.address, upload.path, err)
+		c.mu.Lock()
+		c.compressionUnsupported = true
+		c.mu.Unlock()
+
+		if _, err := upload.reader.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("seek to start: %w", err)
+		}
+	}
+
+	_, err := conn.grpcUploadClient.Upload(ctx, instructions, c.reader(ctx, upload, sent))
+	return err
+}
+
+// reader returns the reader to upload the file from, limited to the
+// --rate-limit. If sent is set, it is reset and hashes everything read.
+func (c *storeClient) reader(ctx context.Context, upload *uploadInfo, sent *xxhash.Digest) io.Reader {
+	var r io.Reader = upload.reader
+	if sent != nil {
+		sent.Reset()
+		r = io.TeeReader(r, sent)
+	}
+	if c.limiter == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: c.limiter}
+}
+
+// rateLimitedReader waits for the limiter to allow every read.
+type rateLimitedReader struct {
+	ctx     context.Context //nolint:containedctx
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Reads cannot wait for more than the burst at once.
+	if len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// store is a Parca debuginfo store to upload to.
+type store struct {
+	address string
+	token   string
+	// tokenFile is re-read every tokenRefresh, if set.
+	tokenFile    string
+	tokenRefresh time.Duration
+}
+
+// storesFromFlags returns the stores to upload to. Bearer tokens can either be
+// given once, applying to all stores, or once per store in the same order as
+// the store addresses.
+func storesFromFlags(sf storeFlags) ([]store, error) {
+	n := len(sf.StoreAddress)
+	if n == 0 {
+		return nil, errors.New("missing flags: --store-address")
+	}
+	if l := len(sf.BearerToken); l > 1 && l != n {
+		return nil, fmt.Errorf("got %d bearer tokens for %d stores, expected either one or one per store", l, n)
+	}
+	if l := len(sf.BearerTokenFile); l > 1 && l != n {
+		return nil, fmt.Errorf("got %d bearer token files for %d stores, expected either one or one per store", l, n)
+	}
+	if sf.BearerTokenRefresh < 0 {
+		return nil, fmt.Errorf("invalid bearer token refresh interval %s, expected a non-negative duration", sf.BearerTokenRefresh)
+	}
+	if sf.BearerTokenRefresh > 0 && len(sf.BearerTokenFile) == 0 {
+		return nil, errors.New("--bearer-token-refresh requires --bearer-token-file")
+	}
+
+	stores := make([]store, 0, n)
+	for i, address := range sf.StoreAddress {
+		s := store{
+			address: address,
+			token:   indexedOrSingle(sf.BearerToken, i),
+		}
+		if path := indexedOrSingle(sf.BearerTokenFile, i); path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read bearer token from file: %w", err)
+			}
+			s.token = string(b)
+			if sf.BearerTokenRefresh > 0 {
+				s.tokenFile = path
+				s.tokenRefresh = sf.BearerTokenRefresh
+			}
+		}
+		stores = append(stores, s)
+	}
+
+	return stores, nil
+}
+
+// indexedOrSingle returns the i-th value, or the only value if there is just one.
+func indexedOrSingle(values []string, i int) string {
+	switch len(values) {
+	case 0:
+		return ""
+	case 1:
+		return values[0]
+	default:
+		return values[i]
+	}
+}
+
+// tempFiles writes files atomically through temporary files, which are tracked
+// so that they can be removed when the command is interrupted.
+type tempFiles struct {
+	// sync makes written files durable before writeFile returns.
+	sync bool
+
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+// writeFile writes to a temporary file in the same directory as path and then
+// renames it to path, so that path never contains partially written data.
+// With sync set, the file is synced before it is renamed and its directory
+// afterwards, so that neither its contents nor its name can be lost.
+func (t *tempFiles) writeFile(path string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	t.track(f.Name())
+	defer t.untrack(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	// os.CreateTemp creates files only readable by the owner, use the same
+	// permissions as os.Create instead.
+	if err := f.Chmod(0o644); err != nil { //nolint:mnd
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("chmod temporary file: %w", err)
+	}
+	if t.sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return fmt.Errorf("sync temporary file: %w", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("close temporary file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("rename temporary file: %w", err)
+	}
+	if t.sync {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("sync directory of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// syncDir syncs the directory at path, which makes the creation and renaming
+// of files in it durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (t *tempFiles) track(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paths == nil {
+		t.paths = map[string]struct{}{}
+	}
+	t.paths[path] = struct{}{}
+}
+
+func (t *tempFiles) untrack(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.paths, path)
+}
+
+// removeAll removes all temporary files that are currently being written.
+func (t *tempFiles) removeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for path := range t.paths {
+		os.Remove(path)
+		delete(t.paths, path)
+	}
+}
+
+func grpcConn(reg prometheus.Registerer, sf storeFlags, s store) (*grpc.ClientConn, error) {
+	if err := validateStoreAddress(s.address); err != nil {
+		return nil, err
+	}
+	if sf.GrpcMaxCallSendSize <= 0 {
+		return nil, fmt.Errorf("gRPC max call send size must be positive, got %d", sf.GrpcMaxCallSendSize)
+	}
+	if sf.GrpcMaxCallRecvSize <= 0 {
+		return nil, fmt.Errorf("gRPC max call receive size must be positive, got %d", sf.GrpcMaxCallRecvSize)
+	}
+	if sf.GrpcChunkSize <= 0 {
+		return nil, fmt.Errorf("gRPC chunk size must be positive, got %d", sf.GrpcChunkSize)
+	}
+	if sf.GrpcChunkSize > sf.GrpcMaxCallSendSize-uploadChunkOverhead {
+		return nil, fmt.Errorf("gRPC chunk size %d does not fit into the max call send size %d", sf.GrpcChunkSize, sf.GrpcMaxCallSendSize)
+	}
+	if sf.MultipartThreshold < 0 {
+		return nil, fmt.Errorf("multipart threshold must not be negative, got %d", sf.MultipartThreshold)
+	}
+
 	met := grpc_prometheus.NewClientMetrics()
 	met.EnableClientHandlingTimeHistogram()
 	reg.MustRegister(met)
@@ -433,60 +2284,284 @@ func grpcConn(reg prometheus.Registerer, flags flags) (*grpc.ClientConn, error)
 		grpc.WithUnaryInterceptor(
 			met.UnaryClientInterceptor(),
 		),
+		grpc.WithDefaultCallOptions(grpcCallOptions(sf)...),
+		grpc.WithUserAgent(userAgent(sf)),
+	}
+	if sf.GrpcKeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    sf.GrpcKeepaliveTime,
+			Timeout: sf.GrpcKeepaliveTimeout,
+		}))
 	}
-	if flags.Upload.Insecure {
+	if sf.Insecure {
 		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	} else {
-		config := &tls.Config{
-			//nolint:gosec
-			InsecureSkipVerify: flags.Upload.InsecureSkipVerify,
-		}
-		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+		cfg := tlsConfig(sf)
+		// Signed URLs point to other hosts, so the name is only used here.
+		cfg.ServerName = sf.TLSServerName
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
 	}
 
-	if flags.Upload.BearerToken != "" {
-		opts = append(opts, grpc.WithPerRPCCredentials(&perRequestBearerToken{
-			token:    flags.Upload.BearerToken,
-			insecure: flags.Upload.Insecure,
+	if s.token != "" || len(sf.GrpcHeader) > 0 {
+		opts = append(opts, grpc.WithPerRPCCredentials(&perRequestCredentials{
+			token:        s.token,
+			tokenFile:    s.tokenFile,
+			tokenRefresh: s.tokenRefresh,
+			tokenRead:    time.Now(),
+			headers:      sf.GrpcHeader,
+			insecure:     sf.Insecure,
 		}))
 	}
 
-	if flags.Upload.BearerTokenFile != "" {
-		b, err := os.ReadFile(flags.Upload.BearerTokenFile)
+	conn, err := grpc.NewClient(s.address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to store at %s: %w", s.address, err)
+	}
+	return conn, nil
+}
+
+// tlsConfig returns the TLS configuration to connect to the store and to
+// signed URLs with.
+func tlsConfig(sf storeFlags) *tls.Config {
+	return &tls.Config{
+		//nolint:gosec
+		InsecureSkipVerify: sf.InsecureSkipVerify,
+	}
+}
+
+// signedURLClient returns the HTTP client to upload to signed URLs with. It
+// uses the same TLS configuration as the gRPC connection, as the object
+// storage behind signed URLs is commonly deployed alongside the store.
+func signedURLClient(sf storeFlags) *http.Client {
+	var rt http.RoundTripper = http.DefaultTransport
+	if transport, ok := http.DefaultTransport.(*http.Transport); ok && sf.InsecureSkipVerify {
+		transport = transport.Clone()
+		transport.TLSClientConfig = tlsConfig(sf)
+		rt = transport
+	}
+	return &http.Client{Transport: &userAgentTransport{rt: rt, userAgent: userAgent(sf)}}
+}
+
+// userAgent returns the User-Agent to identify with to the stores.
+func userAgent(sf storeFlags) string {
+	if sf.UserAgent != "" {
+		return sf.UserAgent
+	}
+	return "parca-debuginfo/" + getBuildInfo().Version
+}
+
+// userAgentTransport sets the User-Agent of every request.
+type userAgentTransport struct {
+	rt        http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.rt.RoundTrip(req)
+}
+
+// validateStoreAddress checks that a store address without a URI scheme is
+// a valid host:port pair, so that typos fail before the first RPC.
+func validateStoreAddress(address string) error {
+	if strings.Contains(address, "://") || strings.HasPrefix(address, "unix:") {
+		// Let gRPC parse target URIs.
+		return nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid store address %q, expected host:port: %w", address, err)
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fmt.Errorf("invalid store address %q: invalid port %q", address, port)
+	}
+	return nil
+}
+
+// waitForReady connects conn and waits until it is ready or the timeout
+// passed. Transient failures are retried by gRPC until then.
+func waitForReady(ctx context.Context, conn *grpc.ClientConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn.Connect()
+	for {
+		state := conn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if state == connectivity.Shutdown {
+			return fmt.Errorf("connect to %s: connection was shut down", conn.Target())
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return fmt.Errorf("connect to %s: not ready after %s, last state %s: %w", conn.Target(), timeout, state, ctx.Err())
+		}
+	}
+}
+
+// grpcCallOptions returns the call options configured via flags that apply to
+// every RPC sent to the store.
+func grpcCallOptions(sf storeFlags) []grpc.CallOption {
+	return []grpc.CallOption{
+		grpc.MaxCallSendMsgSize(sf.GrpcMaxCallSendSize),
+		grpc.MaxCallRecvMsgSize(sf.GrpcMaxCallRecvSize),
+	}
+}
+
+// uploadChunkOverhead is an upper bound of the bytes an UploadRequest adds
+// around its chunk data.
+const uploadChunkOverhead = 16
+
+// uploadServiceClient appends call options to every Upload stream, so that they
+// take precedence over the ones hardcoded by parcadebuginfo.GrpcUploadClient,
+// and re-chunks the uploaded data into chunks of chunkSize.
+type uploadServiceClient struct {
+	debuginfopb.DebuginfoServiceClient
+	opts      []grpc.CallOption
+	chunkSize int
+}
+
+func (c *uploadServiceClient) Upload(ctx context.Context, opts ...grpc.CallOption) (debuginfopb.DebuginfoService_UploadClient, error) {
+	stream, err := c.DebuginfoServiceClient.Upload(ctx, append(opts, c.opts...)...)
+	if err != nil || c.chunkSize == parcadebuginfo.ChunkSize {
+		return stream, err
+	}
+	return &chunkingUploadStream{DebuginfoService_UploadClient: stream, size: c.chunkSize}, nil
+}
+
+// chunkingUploadStream sends the chunk data of an upload in chunks of size,
+// regardless of the chunks it is given.
+type chunkingUploadStream struct {
+	debuginfopb.DebuginfoService_UploadClient
+	size int
+	buf  []byte
+}
+
+func (s *chunkingUploadStream) Send(req *debuginfopb.UploadRequest) error {
+	chunk, ok := req.GetData().(*debuginfopb.UploadRequest_ChunkData)
+	if !ok {
+		return s.DebuginfoService_UploadClient.Send(req)
+	}
+	// The caller reuses its buffer for the next chunk.
+	s.buf = append(s.buf, chunk.ChunkData...)
+	for len(s.buf) >= s.size {
+		if err := s.sendChunk(s.buf[:s.size]); err != nil {
+			return err
+		}
+		s.buf = s.buf[s.size:]
+	}
+	return nil
+}
+
+func (s *chunkingUploadStream) CloseAndRecv() (*debuginfopb.UploadResponse, error) {
+	if len(s.buf) > 0 {
+		err := s.sendChunk(s.buf)
+		if errors.Is(err, io.EOF) {
+			// The store closed the stream, its status has the cause.
+			if rerr := s.RecvMsg(nil); rerr != nil && !errors.Is(rerr, io.EOF) {
+				return nil, rerr
+			}
+			return nil, errors.New("store closed the upload stream")
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to read bearer token from file: %w", err)
+			return nil, fmt.Errorf("send last chunk: %w", err)
 		}
-		opts = append(opts, grpc.WithPerRPCCredentials(&perRequestBearerToken{
-			token:    string(b),
-			insecure: flags.Upload.Insecure,
-		}))
+		s.buf = nil
 	}
+	return s.DebuginfoService_UploadClient.CloseAndRecv()
+}
 
-	return grpc.NewClient(flags.Upload.StoreAddress, opts...)
+func (s *chunkingUploadStream) sendChunk(data []byte) error {
+	return s.DebuginfoService_UploadClient.Send(&debuginfopb.UploadRequest{
+		Data: &debuginfopb.UploadRequest_ChunkData{ChunkData: data},
+	})
 }
 
-type perRequestBearerToken struct {
-	token    string
+// perRequestCredentials attaches the bearer token and any additional headers
+// as metadata to every RPC. If tokenFile is set, the token is re-read from it
+// once tokenRefresh passed since it was last read.
+type perRequestCredentials struct {
+	headers  map[string]string
 	insecure bool
+
+	tokenFile    string
+	tokenRefresh time.Duration
+
+	mu        sync.Mutex
+	token     string
+	tokenRead time.Time
+}
+
+func (t *perRequestCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := t.bearerToken()
+	if err != nil {
+		return nil, err
+	}
+
+	md := make(map[string]string, len(t.headers)+1)
+	for k, v := range t.headers {
+		md[strings.ToLower(k)] = v
+	}
+	if token != "" {
+		md["authorization"] = "Bearer " + token
+	}
+	return md, nil
 }
 
-func (t *perRequestBearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
-	return map[string]string{
-		"authorization": "Bearer " + t.token,
-	}, nil
+// bearerToken returns the current bearer token, re-reading the token file if
+// it is due for a refresh.
+func (t *perRequestCredentials) bearerToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tokenFile == "" || time.Since(t.tokenRead) < t.tokenRefresh {
+		return t.token, nil
+	}
+	b, err := os.ReadFile(t.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to refresh bearer token from file: %w", err)
+	}
+	t.token = string(b)
+	t.tokenRead = time.Now()
+	return t.token, nil
 }
 
-func (t *perRequestBearerToken) RequireTransportSecurity() bool {
+func (t *perRequestCredentials) RequireTransportSecurity() bool {
 	return !t.insecure
 }
 
-func uploadViaSignedURL(ctx context.Context, url string, r io.Reader) error {
+// uploadStrategyName returns the --disable-strategy name of s.
+func uploadStrategyName(s debuginfopb.UploadInstructions_UploadStrategy) string {
+	switch s {
+	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_GRPC:
+		return "grpc"
+	case debuginfopb.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL:
+		return "signed-url"
+	default:
+		return s.String()
+	}
+}
+
+// uploadViaSignedURL uploads r with a single PUT request to the signed URL. The
+// upload instructions of the debuginfo API only carry one signed URL, with no
+// part URLs nor a way to complete a multipart upload, so files larger than
+// --multipart-threshold are rejected before calling it.
+//
+// The request carries the Content-Length and a generic Content-Type, as some
+// object stores include them in the signature. The upload instructions have
+// no field for further headers the signature might require.
+func uploadViaSignedURL(ctx context.Context, client *http.Client, url string, r io.Reader, size int64) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, r)
 	if err != nil {
 		return fmt.Errorf("create request: %w", err)
 	}
+	// Without it, the body of readers other than the in-memory ones of the
+	// http package is sent chunked.
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("do upload request: %w", err)
 	}
@@ -499,6 +2574,63 @@ func uploadViaSignedURL(ctx context.Context, url string, r io.Reader) error {
 	return nil
 }
 
+// debugAltDWARF opens the supplementary DWARF file the --follow-gnu-debugaltlink
+// option of the source command resolves, or returns nil if f has none.
+func debugAltDWARF(flags flags, f *elf.File) (*dwarfData, error) {
+	name, buildID, err := readDebugAltLink(f)
+	if errors.Is(err, errNoDebugAltLink) {
+		verbosef(flags, "%q has no .gnu_debugaltlink section", flags.Source.DebuginfoPath)
+		return nil, nil //nolint:nilnil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := findDebugAltFile(flags.Source.DebuginfoPath, name, buildID, flags.Source.DebugaltlinkDir)
+	if err != nil {
+		return nil, err
+	}
+	verbosef(flags, "Discovering source files from supplementary DWARF file %q", path)
+
+	alt, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open supplementary DWARF file: %w", err)
+	}
+	defer alt.Close()
+
+	// DWARF reads the debug sections into memory, so the file can be closed.
+	d, err := openDWARF(alt)
+	if err != nil {
+		return nil, fmt.Errorf("get dwarf data of %q: %w", path, err)
+	}
+	return d, nil
+}
+
+// uploadType returns the type to upload the file at path as.
+func uploadType(typeName, path string) (debuginfopb.DebuginfoType, error) {
+	if typeName == "auto" {
+		return inferDebuginfoType(path)
+	}
+	return debuginfoTypeStringToPb(typeName), nil
+}
+
+// uploadTypeNames are the values of --type, which can also be given per path.
+var uploadTypeNames = []string{"auto", "debuginfo", "executable", "sources"}
+
+// splitPathType splits an upload argument of the form path:type into the path
+// and the type, falling back to defaultType if there is no type suffix. An
+// existing file whose name happens to end in :type is taken as is.
+func splitPathType(arg, defaultType string) (string, string) {
+	i := strings.LastIndexByte(arg, ':')
+	if i < 0 || !slices.Contains(uploadTypeNames, arg[i+1:]) {
+		return arg, defaultType
+	}
+	if _, err := os.Stat(arg); err == nil {
+		return arg, defaultType
+	}
+	return arg[:i], arg[i+1:]
+}
+
 func debuginfoTypeStringToPb(s string) debuginfopb.DebuginfoType {
 	switch s {
 	case "executable":
@@ -510,8 +2642,82 @@ func debuginfoTypeStringToPb(s string) debuginfopb.DebuginfoType {
 	}
 }
 
+// debuginfoTypeName is the inverse of debuginfoTypeStringToPb.
+func debuginfoTypeName(typ debuginfopb.DebuginfoType) string {
+	switch typ {
+	case debuginfopb.DebuginfoType_DEBUGINFO_TYPE_EXECUTABLE:
+		return "executable"
+	case debuginfopb.DebuginfoType_DEBUGINFO_TYPE_SOURCES:
+		return "sources"
+	default:
+		return "debuginfo"
+	}
+}
+
 var ErrNoBuildID = errors.New("no build ID")
 
+// validateBuildID checks that a Build ID is well-formed before it is sent to the
+// store, to fail with a clear error instead of a server-side rejection.
+func validateBuildID(flags flags, buildID string) error {
+	if buildID == "" {
+		return errors.New("empty Build ID, use --build-id to specify it")
+	}
+	if strings.Trim(buildID, "0123456789abcdefABCDEF") != "" {
+		return fmt.Errorf("%q is not a hex string", buildID)
+	}
+	if !flags.Upload.AllowShortBuildID && len(buildID) < flags.Upload.MinBuildIDLength {
+		return fmt.Errorf("%q is shorter than %d characters, use --allow-short-build-id to upload it anyway", buildID, flags.Upload.MinBuildIDLength)
+	}
+	return nil
+}
+
+// sha256File returns the SHA-256 checksum of the contents of f.
+func sha256File(f io.ReadSeeker) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("seek to start: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("hash file: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// getFileBuildID returns the build ID of the ELF or PE file at the given path.
+func getFileBuildID(path, from string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("open file: %w", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4) //nolint:mnd
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return "", fmt.Errorf("read file magic: %w", err)
+	}
+
+	switch {
+	case string(magic) == elf.ELFMAG:
+		ef, err := elf.NewFile(f)
+		if err != nil {
+			return "", fmt.Errorf("open ELF file: %w", err)
+		}
+		defer ef.Close()
+
+		return getELFBuildID(ef, from)
+	case string(magic[:2]) == "MZ":
+		pf, err := pe.NewFile(f)
+		if err != nil {
+			return "", fmt.Errorf("open PE file: %w", err)
+		}
+		defer pf.Close()
+
+		return GetPEBuildID(pf)
+	default:
+		return "", errors.New("unsupported file format, expected ELF or PE")
+	}
+}
+
 // GetBuildID extracts the build ID from the provided ELF file. This is read from
 // the .note.gnu.build-id or .notes section of the ELF, and may not exist. If no build ID is present
 // an ErrNoBuildID is returned.
@@ -527,6 +2733,47 @@ func GetBuildID(elfFile *elf.File) (string, error) {
 	return getBuildIDFromNotes(sectionData)
 }
 
+// GetGoBuildID extracts the Go build ID from the provided ELF file. This is read
+// from the .note.go.buildid section the Go linker writes, and returned hex
+// encoded like GNU Build IDs. If no Go build ID is present an ErrNoBuildID is
+// returned.
+func GetGoBuildID(elfFile *elf.File) (string, error) {
+	sectionData, err := getSectionData(elfFile, ".note.go.buildid")
+	if err != nil {
+		return "", ErrNoBuildID
+	}
+
+	// 0x4 is the type the Go linker uses for its build ID note, see
+	// cmd/link/internal/ld/elf.go. The ID itself is a string of four
+	// base64-encoded hashes, so allow more room than for a GNU Build ID.
+	buildID, found, err := getNoteHexString(sectionData, "Go", 0x4, 256) //nolint:mnd
+	if err != nil {
+		return "", fmt.Errorf("could not determine Go build ID: %w", err)
+	}
+	if !found {
+		return "", ErrNoBuildID
+	}
+	return buildID, nil
+}
+
+// getELFBuildID returns the build ID of the ELF file selected by from, see
+// --build-id-from. With auto the GNU Build ID is preferred and the Go build
+// ID is only used if there is none.
+func getELFBuildID(elfFile *elf.File, from string) (string, error) {
+	switch from {
+	case "gnu":
+		return GetBuildID(elfFile)
+	case "go":
+		return GetGoBuildID(elfFile)
+	default:
+		buildID, err := GetBuildID(elfFile)
+		if errors.Is(err, ErrNoBuildID) {
+			return GetGoBuildID(elfFile)
+		}
+		return buildID, err
+	}
+}
+
 func getSectionData(elfFile *elf.File, sectionName string) ([]byte, error) {
 	section := elfFile.Section(sectionName)
 	if section == nil {
@@ -542,7 +2789,7 @@ func getSectionData(elfFile *elf.File, sectionName string) ([]byte, error) {
 // getBuildIDFromNotes returns the build ID from an ELF notes section data.
 func getBuildIDFromNotes(notes []byte) (string, error) {
 	// 0x3 is the "Build ID" type. Not sure where this is standardized.
-	buildID, found, err := getNoteHexString(notes, "GNU", 0x3) //nolint:mnd
+	buildID, found, err := getNoteHexString(notes, "GNU", 0x3, 64) //nolint:mnd
 	if err != nil {
 		return "", fmt.Errorf("could not determine BuildID: %w", err)
 	}
@@ -554,7 +2801,7 @@ func getBuildIDFromNotes(notes []byte) (string, error) {
 
 // getNoteHexString returns the hex string contents of an ELF note from a note section, as described
 // in the ELF standard in Figure 2-3.
-func getNoteHexString(sectionBytes []byte, name string, noteType uint32) (string, bool, error) {
+func getNoteHexString(sectionBytes []byte, name string, noteType, maxSize uint32) (string, bool, error) {
 	// The data stored inside ELF notes is made of one or multiple structs, containing the
 	// following fields:
 	// 	- namesz	// 32-bit, size of "name"
@@ -589,8 +2836,8 @@ func getNoteHexString(sectionBytes []byte, name string, noteType uint32) (string
 	dataSize := binary.LittleEndian.Uint32(sectionBytes[idx-4 : idx])
 	idxDataEnd := uint64(idxDataStart) + uint64(dataSize) //nolint:gosec
 
-	// Check sanity (64 is totally arbitrary, as we only use it for Linux ID and Build ID)
-	if idxDataEnd > uint64(len(sectionBytes)) || dataSize > 64 {
+	// Check sanity, maxSize is chosen by the caller for the kind of note it reads.
+	if idxDataEnd > uint64(len(sectionBytes)) || dataSize > maxSize {
 		return "", false, fmt.Errorf(
 			"non-sensical note: %d start index: %d, %v end index %d, size %d, section size %d",
 			idx, idxDataStart, noteHeader, idxDataEnd, dataSize, len(sectionBytes))
@@ -0,0 +1,141 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	"google.golang.org/grpc"
+)
+
+// signedURLStore is a store that asks for every upload to be sent to
+// signedURL.
+type signedURLStore struct {
+	debuginfopb.DebuginfoServiceClient
+	signedURL string
+	finished  atomic.Bool
+}
+
+func (s *signedURLStore) InitiateUpload(_ context.Context, in *debuginfopb.InitiateUploadRequest, _ ...grpc.CallOption) (*debuginfopb.InitiateUploadResponse, error) {
+	return &debuginfopb.InitiateUploadResponse{UploadInstructions: &debuginfopb.UploadInstructions{
+		BuildId:        in.GetBuildId(),
+		UploadId:       "upload",
+		UploadStrategy: debuginfopb.UploadInstructions_UPLOAD_STRATEGY_SIGNED_URL,
+		SignedUrl:      s.signedURL,
+		Type:           in.GetType(),
+	}}, nil
+}
+
+func (s *signedURLStore) MarkUploadFinished(context.Context, *debuginfopb.MarkUploadFinishedRequest, ...grpc.CallOption) (*debuginfopb.MarkUploadFinishedResponse, error) {
+	s.finished.Store(true)
+	return &debuginfopb.MarkUploadFinishedResponse{}, nil
+}
+
+func TestUploadMultipartThreshold(t *testing.T) {
+	data := bytes.Repeat([]byte("debuginfo"), 100)
+	for _, tc := range []struct {
+		name      string
+		threshold int64
+		wantErr   bool
+	}{
+		{name: "unlimited", threshold: 0},
+		{name: "below", threshold: int64(len(data)) + 1},
+		{name: "at", threshold: int64(len(data))},
+		{name: "above", threshold: int64(len(data)) - 1, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var puts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				puts.Add(1)
+				io.Copy(io.Discard, r.Body)
+			}))
+			defer srv.Close()
+
+			store := &signedURLStore{signedURL: srv.URL}
+			c := &storeClient{
+				address:            "test",
+				conns:              []*storeConn{{debuginfoClient: store}},
+				opts:               uploadOptions{skipHash: true},
+				httpClient:         srv.Client(),
+				multipartThreshold: tc.threshold,
+			}
+			var flags flags
+			flags.Quiet = true
+			upload := &uploadInfo{path: "prog", buildID: "0123456789abcdef", reader: bytes.NewReader(data), size: int64(len(data))}
+
+			err := c.upload(context.Background(), flags, upload)
+			if !tc.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if puts.Load() != 1 || !store.finished.Load() {
+					t.Errorf("got %d PUT requests and finished: %v, want 1 and finished", puts.Load(), store.finished.Load())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "--multipart-threshold") {
+				t.Fatalf("upload() error = %v, want error about --multipart-threshold", err)
+			}
+			if puts.Load() != 0 || store.finished.Load() {
+				t.Errorf("got %d PUT requests and finished: %v, want none", puts.Load(), store.finished.Load())
+			}
+		})
+	}
+}
+
+// askedStore is a store that answers whether it wants uploads with err, or
+// with yes if err is nil.
+type askedStore struct {
+	debuginfopb.DebuginfoServiceClient
+	err error
+}
+
+func (s *askedStore) ShouldInitiateUpload(context.Context, *debuginfopb.ShouldInitiateUploadRequest, ...grpc.CallOption) (*debuginfopb.ShouldInitiateUploadResponse, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return &debuginfopb.ShouldInitiateUploadResponse{ShouldInitiateUpload: true}, nil
+}
+
+func TestUploadFileReportsStoreErrorsWhenOpenFails(t *testing.T) {
+	storeErr := errors.New("store is broken")
+	clients := []*storeClient{
+		{address: "broken", conns: []*storeConn{{debuginfoClient: &askedStore{err: storeErr}}}},
+		{address: "working", conns: []*storeConn{{debuginfoClient: &askedStore{}}}},
+	}
+	var flags flags
+	flags.Quiet = true
+	upload := &uploadInfo{path: filepath.Join(t.TempDir(), "missing"), buildID: "0123456789abcdef"}
+
+	err := uploadFile(context.Background(), log.NewNopLogger(), flags, clients, nil, upload)
+	if !errors.Is(err, storeErr) {
+		t.Errorf("uploadFile() error = %v, want it to include %v", err, storeErr)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("uploadFile() error = %v, want it to include that the file does not exist", err)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	imageDirectoryEntryDebug = 6
+	imageDebugTypeCodeView   = 2
+
+	debugDirectorySize = 28
+)
+
+// GetPEBuildID extracts the build ID from the provided PE file. It is made of the
+// GUID and age of the CodeView PDB 7.0 (RSDS) debug record, formatted the same
+// way symbol servers key PDB files. If no such record is present an
+// ErrNoBuildID is returned.
+func GetPEBuildID(f *pe.File) (string, error) {
+	var dd pe.DataDirectory
+	switch oh := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if oh.NumberOfRvaAndSizes <= imageDirectoryEntryDebug {
+			return "", ErrNoBuildID
+		}
+		dd = oh.DataDirectory[imageDirectoryEntryDebug]
+	case *pe.OptionalHeader64:
+		if oh.NumberOfRvaAndSizes <= imageDirectoryEntryDebug {
+			return "", ErrNoBuildID
+		}
+		dd = oh.DataDirectory[imageDirectoryEntryDebug]
+	default:
+		return "", errors.New("missing optional header")
+	}
+	if dd.VirtualAddress == 0 || dd.Size == 0 {
+		return "", ErrNoBuildID
+	}
+
+	dir, err := readPERVA(f, dd.VirtualAddress, dd.Size)
+	if err != nil {
+		return "", fmt.Errorf("read debug directory: %w", err)
+	}
+
+	for len(dir) >= debugDirectorySize {
+		entry := dir[:debugDirectorySize]
+		dir = dir[debugDirectorySize:]
+
+		if binary.LittleEndian.Uint32(entry[12:16]) != imageDebugTypeCodeView {
+			continue
+		}
+		size := binary.LittleEndian.Uint32(entry[16:20])
+		rva := binary.LittleEndian.Uint32(entry[20:24])
+
+		data, err := readPERVA(f, rva, size)
+		if err != nil {
+			return "", fmt.Errorf("read CodeView record: %w", err)
+		}
+		// RSDS signature, 16 bytes GUID, 4 bytes age, followed by the PDB path.
+		if len(data) < 24 || string(data[:4]) != "RSDS" { //nolint:mnd
+			continue
+		}
+		guid := data[4:20]
+		age := binary.LittleEndian.Uint32(data[20:24])
+
+		return fmt.Sprintf("%08x%04x%04x%x%x",
+			binary.LittleEndian.Uint32(guid[0:4]),
+			binary.LittleEndian.Uint16(guid[4:6]),
+			binary.LittleEndian.Uint16(guid[6:8]),
+			guid[8:16],
+			age,
+		), nil
+	}
+
+	return "", ErrNoBuildID
+}
+
+// readPERVA reads size bytes at the relative virtual address rva.
+func readPERVA(f *pe.File, rva, size uint32) ([]byte, error) {
+	for _, s := range f.Sections {
+		if rva < s.VirtualAddress || rva >= s.VirtualAddress+s.VirtualSize {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, err
+		}
+		start := uint64(rva - s.VirtualAddress)
+		end := start + uint64(size)
+		if end > uint64(len(data)) {
+			return nil, fmt.Errorf("address range %#x-%#x exceeds section %s", rva, uint64(rva)+uint64(size), s.Name)
+		}
+		return data[start:end], nil
+	}
+	return nil, fmt.Errorf("address %#x not in any section", rva)
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// pingBuildID is the Build ID asked about to check a store. Stores only look
+// it up, so it does not need to exist.
+const pingBuildID = "0000000000000000000000000000000000000000"
+
+// pingResult is the outcome of checking a single store.
+type pingResult struct {
+	Address   string `json:"address"`
+	OK        bool   `json:"ok"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+
+	latency time.Duration
+}
+
+// pingStore connects to the store s and asks it whether the probe Build ID
+// should be uploaded, which requires the store to be reachable and to accept
+// the credentials. The latency includes establishing the connection.
+func pingStore(ctx context.Context, sf storeFlags, s store) pingResult {
+	res := pingResult{Address: s.address}
+
+	start := time.Now()
+	err := func() error {
+		c, err := newStoreClient(ctx, sf, s, 1, uploadOptions{})
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+
+		_, err = c.pick().debuginfoClient.ShouldInitiateUpload(ctx, &debuginfopb.ShouldInitiateUploadRequest{
+			BuildId: pingBuildID,
+		})
+		switch status.Code(err) {
+		case codes.OK:
+			return nil
+		case codes.Unavailable:
+			return fmt.Errorf("cannot connect to store: %w", err)
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return fmt.Errorf("store rejected the credentials: %w", err)
+		default:
+			return fmt.Errorf("check if upload should be initiated: %w", err)
+		}
+	}()
+	res.latency = time.Since(start)
+	res.LatencyMs = res.latency.Milliseconds()
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.OK = true
+	}
+	return res
+}
+
+func (r pingResult) print(w io.Writer, output string) {
+	if output == "json" {
+		_ = json.NewEncoder(w).Encode(r)
+		return
+	}
+	if r.OK {
+		fmt.Fprintf(w, "%s: ok (%s)\n", r.Address, r.latency.Round(time.Millisecond))
+		return
+	}
+	fmt.Fprintf(w, "%s: failed after %s: %s\n", r.Address, r.latency.Round(time.Millisecond), r.Error)
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// markFinishedBackoff is the delay before the first retry of marking an upload
+// as finished, doubled for every further retry.
+const markFinishedBackoff = 500 * time.Millisecond
+
+// unfinishedUpload is an upload that was transferred to a store, but could not
+// be marked as finished. It is persisted to --resume-file, so that a later run
+// can mark it as finished without transferring the file again.
+type unfinishedUpload struct {
+	Store    string `json:"store"`
+	BuildID  string `json:"build_id"`
+	UploadID string `json:"upload_id"`
+	Type     string `json:"type"`
+}
+
+// markFinished marks an upload as finished, retrying transient failures up to
+// --mark-finished-retries times.
+func (c *storeClient) markFinished(ctx context.Context, flags flags, u unfinishedUpload) error {
+	req := &debuginfopb.MarkUploadFinishedRequest{
+		BuildId:  u.BuildID,
+		UploadId: u.UploadID,
+		Type:     debuginfopb.DebuginfoType(debuginfopb.DebuginfoType_value[u.Type]),
+	}
+
+	backoff := markFinishedBackoff
+	for attempt := 0; ; attempt++ {
+		_, err := c.pick().debuginfoClient.MarkUploadFinished(ctx, req)
+		if err == nil || attempt >= c.opts.markFinishedRetries || !isTransient(err) {
+			return err
+		}
+
+		verbosef(flags, "Marking upload with Build ID %q to %s as finished failed, retrying in %s: %v", u.BuildID, c.address, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether a failed RPC may succeed if retried.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// finishUploads marks the uploads recorded in a previous run's resume file as
+// finished, and returns the ones that still are not.
+func finishUploads(ctx context.Context, logger log.Logger, flags flags, clients []*storeClient, uploads []unfinishedUpload) []unfinishedUpload {
+	var remaining []unfinishedUpload
+	for _, u := range uploads {
+		i := slices.IndexFunc(clients, func(c *storeClient) bool { return c.address == u.Store })
+		if i < 0 {
+			// The store is not uploaded to in this run, keep it for later.
+			remaining = append(remaining, u)
+			continue
+		}
+
+		if err := clients[i].markFinished(ctx, flags, u); err != nil {
+			level.Warn(logger).Log("msg", "failed to mark previously transferred upload as finished", "store", u.Store, "build_id", u.BuildID, "err", err)
+			remaining = append(remaining, u)
+			continue
+		}
+		infof(flags, "Marked previously transferred upload with Build ID %q to %s as finished", u.BuildID, u.Store)
+	}
+	return remaining
+}
+
+// readResumeFile reads the unfinished uploads of a previous run. A missing file
+// means there are none.
+func readResumeFile(path string) ([]unfinishedUpload, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read resume file: %w", err)
+	}
+
+	var uploads []unfinishedUpload
+	if err := json.Unmarshal(b, &uploads); err != nil {
+		return nil, fmt.Errorf("parse resume file %q: %w", path, err)
+	}
+	return uploads, nil
+}
+
+// writeResumeFile records the unfinished uploads for the next run, or removes
+// the file if there are none.
+func writeResumeFile(path string, uploads []unfinishedUpload) error {
+	if len(uploads) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove resume file: %w", err)
+		}
+		return nil
+	}
+
+	tmps := &tempFiles{}
+	if err := tmps.writeFile(path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(uploads)
+	}); err != nil {
+		return fmt.Errorf("write resume file: %w", err)
+	}
+	return nil
+}
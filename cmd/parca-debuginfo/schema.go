@@ -0,0 +1,133 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/alecthomas/kong"
+)
+
+// commandSchema describes a command, its flags, arguments and subcommands,
+// for tools that wrap the CLI.
+type commandSchema struct {
+	Name      string           `json:"name"`
+	Help      string           `json:"help,omitempty"`
+	Flags     []flagSchema     `json:"flags,omitempty"`
+	Arguments []argumentSchema `json:"arguments,omitempty"`
+	Commands  []commandSchema  `json:"commands,omitempty"`
+}
+
+type flagSchema struct {
+	Name  string `json:"name"`
+	Short string `json:"short,omitempty"`
+	// Type is the Go type of the flag, e.g. time.Duration or []string.
+	Type       string   `json:"type"`
+	Help       string   `json:"help,omitempty"`
+	Default    *string  `json:"default,omitempty"`
+	Enum       []string `json:"enum,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	Required   bool     `json:"required,omitempty"`
+	Repeatable bool     `json:"repeatable,omitempty"`
+	Xor        []string `json:"xor,omitempty"`
+}
+
+type argumentSchema struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	Help       string  `json:"help,omitempty"`
+	Default    *string `json:"default,omitempty"`
+	Required   bool    `json:"required,omitempty"`
+	Repeatable bool    `json:"repeatable,omitempty"`
+}
+
+// writeSchema writes the description of all commands and flags that are not
+// hidden to w as JSON.
+func writeSchema(w io.Writer, app *kong.Application) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(nodeSchema(app.Node))
+}
+
+func nodeSchema(n *kong.Node) commandSchema {
+	c := commandSchema{Name: n.Name, Help: n.Help}
+	for _, f := range n.Flags {
+		if f.Hidden {
+			continue
+		}
+		fs := flagSchema{
+			Name:       f.Name,
+			Type:       valueType(f.Value),
+			Help:       f.Help,
+			Default:    valueDefault(f.Value),
+			Enum:       enumValues(f.Value),
+			Env:        f.Envs,
+			Required:   f.Required,
+			Repeatable: f.IsSlice() || f.IsMap(),
+			Xor:        f.Xor,
+		}
+		if f.Short != 0 {
+			fs.Short = string(f.Short)
+		}
+		c.Flags = append(c.Flags, fs)
+	}
+	for _, p := range n.Positional {
+		c.Arguments = append(c.Arguments, argumentSchema{
+			Name:       p.Name,
+			Type:       valueType(p),
+			Help:       p.Help,
+			Default:    valueDefault(p),
+			Required:   p.Required,
+			Repeatable: p.IsSlice(),
+		})
+	}
+	for _, child := range n.Children {
+		if child.Hidden {
+			continue
+		}
+		c.Commands = append(c.Commands, nodeSchema(child))
+	}
+	return c
+}
+
+// valueType returns the Go type of v, reporting the help flag and other
+// boolean kong types as bool.
+func valueType(v *kong.Value) string {
+	if v.IsBool() {
+		return "bool"
+	}
+	return v.Target.Type().String()
+}
+
+func valueDefault(v *kong.Value) *string {
+	if !v.HasDefault {
+		return nil
+	}
+	return &v.Default
+}
+
+func enumValues(v *kong.Value) []string {
+	if v.Enum == "" {
+		return nil
+	}
+	enum := v.EnumSlice()
+	for i, e := range enum {
+		enum[i] = strings.TrimSpace(e)
+	}
+	return enum
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+)
+
+// seenBuildIDs are the Build IDs recorded in --seen-build-ids-file. The file
+// has one Build ID per line, followed by the type it was uploaded as, and
+// uploads are appended to it as soon as they are done, so that they are not
+// lost if the run is interrupted.
+type seenBuildIDs struct {
+	mu   sync.Mutex
+	f    *os.File
+	seen map[string]struct{}
+}
+
+// openSeenBuildIDs reads the Build IDs recorded in the file at path, which is
+// created if it does not exist.
+func openSeenBuildIDs(path string) (*seenBuildIDs, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644) //nolint:mnd
+	if err != nil {
+		return nil, fmt.Errorf("open seen Build IDs file: %w", err)
+	}
+
+	s := &seenBuildIDs{f: f, seen: map[string]struct{}{}}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			// Build IDs without type were uploaded as debuginfo.
+			fields = append(fields, "debuginfo")
+		}
+		s.seen[seenKey(fields[0], fields[1])] = struct{}{}
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read seen Build IDs file %q: %w", path, err)
+	}
+	return s, nil
+}
+
+func seenKey(buildID, typ string) string {
+	return buildID + " " + typ
+}
+
+// contains reports whether the Build ID was uploaded as typ before.
+func (s *seenBuildIDs) contains(buildID string, typ debuginfopb.DebuginfoType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.seen[seenKey(buildID, debuginfoTypeName(typ))]
+	return ok
+}
+
+// add records that the Build ID was uploaded as typ.
+func (s *seenBuildIDs) add(buildID string, typ debuginfopb.DebuginfoType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := seenKey(buildID, debuginfoTypeName(typ))
+	if _, ok := s.seen[key]; ok {
+		return nil
+	}
+	if _, err := fmt.Fprintln(s.f, key); err != nil {
+		return fmt.Errorf("write seen Build IDs file: %w", err)
+	}
+	s.seen[key] = struct{}{}
+	return nil
+}
+
+func (s *seenBuildIDs) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-kit/log"
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+	"github.com/rzajac/flexbuf"
+)
+
+// selftestCompileUnit is the name of the compile unit of the synthesized ELF
+// file.
+const selftestCompileUnit = "selftest.c"
+
+// selftestBuildID returns the Build ID of the synthesized ELF file. It is the
+// same on every run, so that round-trips to a store replace the previous one.
+func selftestBuildID() []byte {
+	id := sha1.Sum([]byte("parca-debuginfo selftest")) //nolint:gosec
+	return id[:]
+}
+
+// synthesizeELF returns a minimal 64-bit little-endian ELF file with a GNU
+// Build ID note and a single DWARF compile unit.
+func synthesizeELF(buildID []byte) []byte {
+	// Build ID note: GNU name, type 3 (NT_GNU_BUILD_ID), padded to 4 bytes.
+	var note bytes.Buffer
+	binary.Write(&note, binary.LittleEndian, []uint32{4, uint32(len(buildID)), 3}) //nolint:errcheck,gosec,mnd
+	note.WriteString("GNU\x00")
+	note.Write(buildID)
+	for note.Len()%4 != 0 {
+		note.WriteByte(0)
+	}
+
+	// Abbreviation 1: DW_TAG_compile_unit without children and a
+	// DW_AT_name of DW_FORM_string, followed by the terminating entries.
+	abbrev := []byte{1, byte(dwarf.TagCompileUnit), 0, byte(dwarf.AttrName), 0x08, 0, 0, 0} //nolint:mnd
+
+	// DWARF 4 compile unit header with 8 byte addresses, and the DIE.
+	var die bytes.Buffer
+	binary.Write(&die, binary.LittleEndian, uint16(4)) //nolint:errcheck,mnd
+	binary.Write(&die, binary.LittleEndian, uint32(0)) //nolint:errcheck
+	die.WriteByte(8)                                   //nolint:mnd
+	die.WriteByte(1)
+	die.WriteString(selftestCompileUnit + "\x00")
+	var info bytes.Buffer
+	binary.Write(&info, binary.LittleEndian, uint32(die.Len())) //nolint:errcheck,gosec
+	info.Write(die.Bytes())
+
+	sections := []struct {
+		name  string
+		typ   elf.SectionType
+		flags elf.SectionFlag
+		align uint64
+		data  []byte
+	}{
+		{name: ".note.gnu.build-id", typ: elf.SHT_NOTE, flags: elf.SHF_ALLOC, align: 4, data: note.Bytes()},
+		{name: ".debug_abbrev", typ: elf.SHT_PROGBITS, align: 1, data: abbrev},
+		{name: ".debug_info", typ: elf.SHT_PROGBITS, align: 1, data: info.Bytes()},
+		{name: ".shstrtab", typ: elf.SHT_STRTAB, align: 1},
+	}
+
+	shstrtab := []byte{0}
+	names := make([]uint32, len(sections))
+	for i, s := range sections {
+		names[i] = uint32(len(shstrtab)) //nolint:gosec
+		shstrtab = append(shstrtab, s.name...)
+		shstrtab = append(shstrtab, 0)
+	}
+	sections[len(sections)-1].data = shstrtab
+
+	const ehsize, shentsize = 64, 64
+	var body bytes.Buffer
+	hdrs := []elf.Section64{{}}
+	for i, s := range sections {
+		off := ehsize + uint64(body.Len()) //nolint:gosec
+		if pad := (s.align - off%s.align) % s.align; pad > 0 {
+			body.Write(make([]byte, pad))
+			off += pad
+		}
+		body.Write(s.data)
+		hdrs = append(hdrs, elf.Section64{
+			Name:      names[i],
+			Type:      uint32(s.typ),
+			Flags:     uint64(s.flags),
+			Off:       off,
+			Size:      uint64(len(s.data)),
+			Addralign: s.align,
+		})
+	}
+	for (ehsize+body.Len())%8 != 0 {
+		body.WriteByte(0)
+	}
+
+	ehdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     ehsize + uint64(body.Len()), //nolint:gosec
+		Ehsize:    ehsize,
+		Shentsize: shentsize,
+		Shnum:     uint16(len(hdrs)),     //nolint:gosec
+		Shstrndx:  uint16(len(hdrs) - 1), //nolint:gosec
+	}
+	copy(ehdr.Ident[:], elf.ELFMAG)
+	ehdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ehdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ehdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, ehdr) //nolint:errcheck
+	out.Write(body.Bytes())
+	binary.Write(&out, binary.LittleEndian, hdrs) //nolint:errcheck
+	return out.Bytes()
+}
+
+// selftestStep prints the outcome of a step of the self-test.
+func selftestStep(w io.Writer, step string, err error) error {
+	if err != nil {
+		fmt.Fprintf(w, "FAIL  %s: %v\n", step, err)
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	fmt.Fprintf(w, "ok    %s\n", step)
+	return nil
+}
+
+// runSelftest extracts the debug information of a synthesized ELF file and
+// checks the result. If store addresses are given, the result is also
+// uploaded to the stores, which must afterwards report it as present.
+func runSelftest(ctx context.Context, logger log.Logger, flags flags, w io.Writer) error {
+	id := selftestBuildID()
+	buildID := hex.EncodeToString(id)
+	data := synthesizeELF(id)
+
+	src := bytes.NewReader(data)
+	if err := selftestStep(w, "read Build ID of synthesized ELF file", func() error {
+		f, err := elf.NewFile(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		got, err := GetBuildID(f)
+		if err != nil {
+			return err
+		}
+		if got != buildID {
+			return fmt.Errorf("got Build ID %q, expected %q", got, buildID)
+		}
+		return nil
+	}()); err != nil {
+		return err
+	}
+
+	out := &flexbuf.Buffer{}
+	if err := selftestStep(w, "extract debug information", onlyKeepDebug(logger, out, nopCloserReaderAt{src}, extractFlags{})); err != nil {
+		return err
+	}
+	if err := selftestStep(w, "verify Build ID of extracted debug information", verifyExtractedBuildID(out, buildID, "gnu")); err != nil {
+		return err
+	}
+	if err := selftestStep(w, "read DWARF of extracted debug information", checkSelftestDWARF(out)); err != nil {
+		return err
+	}
+
+	if len(flags.Selftest.StoreAddress) == 0 {
+		return nil
+	}
+
+	clients, err := newStoreClients(ctx, flags.Selftest.storeFlags, 1, uploadOptions{force: true})
+	if err := selftestStep(w, "connect to stores", err); err != nil {
+		return err
+	}
+	defer closeStoreClients(clients)
+
+	out.SeekStart()
+	upload := &uploadInfo{
+		path:    "selftest",
+		buildID: buildID,
+		typ:     debuginfopb.DebuginfoType_DEBUGINFO_TYPE_DEBUGINFO_UNSPECIFIED,
+		reader:  out,
+		size:    int64(out.Len()),
+	}
+	for _, c := range clients {
+		if err := selftestStep(w, "upload to "+c.address, func() error {
+			pending, err := pendingStores(ctx, flags, []*storeClient{c}, upload)
+			if err != nil {
+				return err
+			}
+			if len(pending) == 0 {
+				return fmt.Errorf("store did not accept the upload: %s", upload.skipped[len(upload.skipped)-1].Reason)
+			}
+			return uploadToStores(ctx, flags, pending, upload)
+		}()); err != nil {
+			return err
+		}
+		if err := selftestStep(w, "check upload is present in "+c.address, func() error {
+			resp, err := c.pick().debuginfoClient.ShouldInitiateUpload(ctx, &debuginfopb.ShouldInitiateUploadRequest{
+				BuildId: buildID,
+				Type:    upload.typ,
+			})
+			if err != nil {
+				return err
+			}
+			if resp.GetShouldInitiateUpload() {
+				return fmt.Errorf("store still wants the upload: %s", resp.GetReason())
+			}
+			return nil
+		}()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSelftestDWARF checks that the extracted debug information still holds
+// the compile unit of the synthesized ELF file.
+func checkSelftestDWARF(extracted io.ReaderAt) error {
+	f, err := elf.NewFile(extracted)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d, err := f.DWARF()
+	if err != nil {
+		return err
+	}
+	cu, err := d.Reader().Next()
+	if err != nil {
+		return err
+	}
+	if cu == nil || cu.Tag != dwarf.TagCompileUnit {
+		return errors.New("no compile unit found")
+	}
+	if name, _ := cu.Val(dwarf.AttrName).(string); name != selftestCompileUnit {
+		return fmt.Errorf("got compile unit %q, expected %q", name, selftestCompileUnit)
+	}
+	return nil
+}
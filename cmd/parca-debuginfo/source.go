@@ -0,0 +1,706 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultSourceCompressionLevel is the zstd level of source archives uploaded
+// with upload --with-sources, the default --compression-level of source.
+const defaultSourceCompressionLevel = 3
+
+// validateSourceCompression checks that level is a valid level of the source
+// archive compression.
+func validateSourceCompression(compression string, level int) error {
+	minLevel, maxLevel := 1, 22
+	if compression == "brotli" {
+		minLevel, maxLevel = brotli.BestSpeed, brotli.BestCompression
+	}
+	if level < minLevel || level > maxLevel {
+		return fmt.Errorf("--compression-level must be between %d and %d for %s, got %d", minLevel, maxLevel, compression, level)
+	}
+	return nil
+}
+
+// sourceArchiveExtension returns the file extension of source archives
+// compressed with compression.
+func sourceArchiveExtension(compression string) string {
+	if compression == "brotli" {
+		return ".tar.br"
+	}
+	return ".tar.zstd"
+}
+
+// newSourceCompressor wraps w in a writer that compresses the tar stream of a
+// source archive.
+func newSourceCompressor(w io.Writer, compression string, level int) (io.WriteCloser, error) {
+	if compression == "brotli" {
+		return brotli.NewWriterLevel(w, level), nil
+	}
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return nil, fmt.Errorf("create zstd writer: %w", err)
+	}
+	return zw, nil
+}
+
+// sourceArchiver writes source files to a tar archive. Symlinks and hardlinks
+// between files of the archive are kept as links, all other files are copied.
+type sourceArchiver struct {
+	logger log.Logger
+	tw     *tar.Writer
+	opts   sourceArchiveOptions
+
+	names   []string
+	members map[string]struct{}
+	// links maps the identity of a file with multiple hardlinks to the
+	// first name it was archived under.
+	links map[fileID]string
+	// files records what happened to every referenced source file.
+	files    []sourceFileStatus
+	included int
+}
+
+type sourceArchiveOptions struct {
+	// stripComponents is the number of leading path components removed
+	// from the archived names.
+	stripComponents int
+	// relativeTo is the directory the names of the files below it are
+	// made relative to, if set.
+	relativeTo string
+	// strictRelative excludes the files outside of relativeTo.
+	strictRelative bool
+	// buildID is the Build ID of the debuginfo file the sources belong to.
+	buildID string
+	// maxFiles is the maximum number of files to archive, unlimited if zero.
+	maxFiles int
+	// originalPaths maps canonicalized names to the paths they were
+	// referenced as, if they differ.
+	originalPaths map[string]string
+	// debuginfod fetches the files that do not exist locally, if set.
+	debuginfod *debuginfodClient
+	// cache provides the content hashes of the files unchanged since they
+	// were last archived, if set. The hashes of the other files are
+	// calculated while copying them.
+	cache *sourceCache
+}
+
+const (
+	sourceFileIncluded = "included"
+	sourceFileSkipped  = "skipped"
+	sourceFileExcluded = "excluded"
+)
+
+// sourceFileStatus records whether a referenced source file was archived.
+type sourceFileStatus struct {
+	Path string `json:"path"`
+	// OriginalPath is set if the path was canonicalized.
+	OriginalPath string `json:"original_path,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Status       string `json:"status"`
+	Reason       string `json:"reason,omitempty"`
+	Size         int64  `json:"size"`
+	// Hash is the content hash of archived regular files, known with a
+	// source cache.
+	Hash string `json:"hash,omitempty"`
+	// FetchedFrom is the URL the file was fetched from instead of read
+	// locally.
+	FetchedFrom string `json:"fetched_from,omitempty"`
+}
+
+// sourceBuildIDRecord is the PAX record of the global header of the archive
+// holding the Build ID of the debuginfo file the sources belong to.
+const sourceBuildIDRecord = "PARCA.build_id"
+
+// sourceManifestName is the name of the archive entry listing the original
+// paths of the archived files, written when their names are rewritten.
+const sourceManifestName = ".parca-source-manifest.json"
+
+type sourceManifestEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// writeSourceArchive writes a tar archive of the source files names, compressed
+// with compression at the given level, to w.
+func writeSourceArchive(ctx context.Context, logger log.Logger, w io.Writer, names []string, compression string, level int, opts sourceArchiveOptions) (*sourceArchiver, error) {
+	zw, err := newSourceCompressor(w, compression, level)
+	if err != nil {
+		return nil, err
+	}
+	defer zw.Close()
+
+	tw := tar.NewWriter(zw)
+	defer tw.Close()
+
+	a := newSourceArchiver(logger, tw, names, opts)
+	if err := a.writeAll(ctx); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("close tar writer: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("close %s writer: %w", compression, err)
+	}
+	return a, nil
+}
+
+func newSourceArchiver(logger log.Logger, tw *tar.Writer, names []string, opts sourceArchiveOptions) *sourceArchiver {
+	members := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		members[filepath.Clean(name)] = struct{}{}
+	}
+	return &sourceArchiver{
+		logger:  logger,
+		tw:      tw,
+		opts:    opts,
+		names:   names,
+		members: members,
+		links:   map[fileID]string{},
+	}
+}
+
+func (a *sourceArchiver) writeAll(ctx context.Context) error {
+	if a.opts.buildID != "" {
+		// Tar implementations ignore global headers when extracting.
+		if err := a.tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{sourceBuildIDRecord: a.opts.buildID},
+		}); err != nil {
+			return fmt.Errorf("write global header: %w", err)
+		}
+	}
+
+	for i, name := range a.names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if a.opts.maxFiles > 0 && a.included >= a.opts.maxFiles {
+			rest := a.names[i:]
+			level.Warn(a.logger).Log("msg", "reached maximum number of source files, skipping the remaining ones", "max", a.opts.maxFiles, "skipped", len(rest))
+			for _, name := range rest {
+				a.files = append(a.files, sourceFileStatus{Path: name, Status: sourceFileExcluded, Reason: "maximum number of source files reached"})
+			}
+			break
+		}
+		if err := a.write(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	if a.opts.stripComponents == 0 && a.opts.relativeTo == "" {
+		return nil
+	}
+	return a.writeManifest()
+}
+
+func (a *sourceArchiver) writeManifest() error {
+	var entries []sourceManifestEntry
+	for _, f := range a.files {
+		if f.Status == sourceFileIncluded {
+			entries = append(entries, sourceManifestEntry{Name: f.Name, Path: f.Path})
+		}
+	}
+
+	data, err := json.MarshalIndent(struct {
+		BuildID string                `json:"build_id,omitempty"`
+		Files   []sourceManifestEntry `json:"files"`
+	}{BuildID: a.opts.buildID, Files: entries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	if err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     sourceManifestName,
+		Size:     int64(len(data)),
+		Mode:     0o644, //nolint:mnd
+		ModTime:  time.Now(),
+	}); err != nil {
+		return fmt.Errorf("write tar header: %w", err)
+	}
+	if _, err := a.tw.Write(data); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+// sourceEstimate summarizes what archiving the source files would include.
+type sourceEstimate struct {
+	referenced int
+	included   int
+	missing    int
+	excluded   int
+	// size is the total uncompressed size of the included files.
+	size int64
+}
+
+// estimate stats the source files to tell what writeAll would archive,
+// without reading or writing any of them.
+func (a *sourceArchiver) estimate() (sourceEstimate, error) {
+	e := sourceEstimate{referenced: len(a.names)}
+	for _, name := range a.names {
+		if _, reason := a.entryName(name); reason != "" {
+			e.excluded++
+			continue
+		}
+		if a.opts.maxFiles > 0 && e.included >= a.opts.maxFiles {
+			e.excluded++
+			continue
+		}
+
+		fi, err := os.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			e.missing++
+			continue
+		}
+		if err != nil {
+			return sourceEstimate{}, fmt.Errorf("stat file: %w", err)
+		}
+		e.included++
+		e.size += fi.Size()
+	}
+	return e, nil
+}
+
+// writeReport writes the status of every referenced source file to w as JSON.
+func (a *sourceArchiver) writeReport(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(struct {
+		Files []sourceFileStatus `json:"files"`
+	}{Files: a.files})
+}
+
+func (a *sourceArchiver) skip(name, status, reason string) {
+	level.Warn(a.logger).Log("msg", "skipping file, "+reason, "file", name)
+	a.files = append(a.files, sourceFileStatus{Path: name, OriginalPath: a.opts.originalPaths[name], Status: status, Reason: reason})
+}
+
+func (a *sourceArchiver) include(name, entry string, size int64) {
+	a.files = append(a.files, sourceFileStatus{Path: name, OriginalPath: a.opts.originalPaths[name], Name: entry, Status: sourceFileIncluded, Size: size})
+	a.included++
+}
+
+// entryName returns the archive entry name of the file at path, relative to
+// relativeTo if the file is below it, and with stripComponents leading path
+// components removed. If the file is excluded from the archive instead, it
+// returns the reason: like tar, if path has no components left after
+// stripping, or with strictRelative if it is not below relativeTo.
+func (a *sourceArchiver) entryName(path string) (string, string) {
+	if a.opts.relativeTo != "" {
+		rel, ok := relativeName(a.opts.relativeTo, path)
+		switch {
+		case ok:
+			path = rel
+		case a.opts.strictRelative:
+			return "", "it is not below --relative-to"
+		}
+	}
+	if a.opts.stripComponents == 0 {
+		return path, ""
+	}
+	parts := strings.Split(strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "/"), "/")
+	if len(parts) <= a.opts.stripComponents {
+		return "", "it has too few path components to strip"
+	}
+	return strings.Join(parts[a.opts.stripComponents:], "/"), ""
+}
+
+// relativeName returns the path of the file at path relative to dir, if it
+// is below dir.
+func relativeName(dir, path string) (string, bool) {
+	if !filepath.IsAbs(path) {
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (a *sourceArchiver) write(ctx context.Context, name string) error {
+	entry, reason := a.entryName(name)
+	if reason != "" {
+		a.skip(name, sourceFileExcluded, reason)
+		return nil
+	}
+
+	lstat, err := os.Lstat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		if a.opts.debuginfod != nil && a.opts.buildID != "" {
+			return a.writeFetched(ctx, name, entry)
+		}
+		a.skip(name, sourceFileSkipped, "it does not exist")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+
+	if lstat.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(name)
+		if err != nil {
+			return fmt.Errorf("read symlink: %w", err)
+		}
+		if a.isMember(name, target) {
+			if err := a.tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     entry,
+				Linkname: target,
+				Mode:     int64(lstat.Mode().Perm()),
+				ModTime:  lstat.ModTime(),
+			}); err != nil {
+				return fmt.Errorf("write tar header: %w", err)
+			}
+			var size int64
+			if stat, err := os.Stat(name); err == nil {
+				size = stat.Size()
+			}
+			a.include(name, entry, size)
+			return nil
+		}
+		// The target is not part of the archive, so archive its contents
+		// under the name of the symlink instead.
+	}
+
+	sourceFile, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		a.skip(name, sourceFileSkipped, "symlink target does not exist")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	defer sourceFile.Close()
+
+	stat, err := sourceFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat file: %w", err)
+	}
+
+	mode := int64(stat.Mode().Perm())
+	if mode == 0 {
+		mode = 0o644 //nolint:mnd
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry,
+		Size:     stat.Size(),
+		Mode:     mode,
+		ModTime:  stat.ModTime(),
+	}
+
+	// Hardlinks are only recorded for regular files that were archived as
+	// is, not for symlink targets copied under another name.
+	if id, ok := getFileID(lstat); ok {
+		if first, ok := a.links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			a.links[id] = entry
+		}
+	}
+
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write tar header: %w", err)
+	}
+	a.include(name, entry, stat.Size())
+	if hdr.Typeflag == tar.TypeLink {
+		return nil
+	}
+	status := &a.files[len(a.files)-1]
+
+	// With a cache, files that are not in it are hashed while they are
+	// copied.
+	var (
+		r      io.Reader = &contextReader{ctx: ctx, r: sourceFile}
+		hasher *xxhash.Digest
+	)
+	if a.opts.cache != nil {
+		if h, ok := a.opts.cache.lookup(name, stat); ok {
+			status.Hash = h
+		} else {
+			hasher = xxhash.New()
+			r = io.TeeReader(r, hasher)
+		}
+	}
+
+	if _, err = io.Copy(a.tw, r); err != nil {
+		return fmt.Errorf("copy file to tar: %w", err)
+	}
+	if hasher != nil {
+		status.Hash = hex.EncodeToString(hasher.Sum(nil))
+		if err := a.opts.cache.store(name, stat, status.Hash); err != nil {
+			level.Warn(a.logger).Log("msg", "failed to update source cache", "file", name, "err", err)
+		}
+	}
+
+	if err := sourceFile.Close(); err != nil {
+		return fmt.Errorf("close file: %w", err)
+	}
+	return nil
+}
+
+// writeFetched archives the file at name from the debuginfod servers, as it
+// does not exist locally.
+func (a *sourceArchiver) writeFetched(ctx context.Context, name, entry string) error {
+	s, err := a.opts.debuginfod.source(ctx, a.opts.buildID, name)
+	if errors.Is(err, errSourceNotFound) {
+		a.skip(name, sourceFileSkipped, "it does not exist locally or on the debuginfod servers")
+		return nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		level.Warn(a.logger).Log("msg", "failed to fetch source file from debuginfod", "file", name, "err", err)
+		a.skip(name, sourceFileSkipped, "it does not exist and fetching it from debuginfod failed")
+		return nil
+	}
+
+	if err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry,
+		Size:     int64(len(s.data)),
+		Mode:     0o644, //nolint:mnd
+		ModTime:  s.modTime,
+	}); err != nil {
+		return fmt.Errorf("write tar header: %w", err)
+	}
+	if _, err := a.tw.Write(s.data); err != nil {
+		return fmt.Errorf("write fetched file to tar: %w", err)
+	}
+	a.include(name, entry, int64(len(s.data)))
+	a.files[len(a.files)-1].FetchedFrom = s.url
+	return nil
+}
+
+// isMember reports whether the symlink target, relative to the directory of
+// the symlink at name, is archived itself and exists.
+func (a *sourceArchiver) isMember(name, target string) bool {
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(name), target)
+	}
+	target = filepath.Clean(target)
+	if _, ok := a.members[target]; !ok {
+		return false
+	}
+	_, err := os.Stat(target)
+	return err == nil
+}
+
+// contextReader stops reading once ctx is done, so that copying large files
+// can be interrupted.
+type contextReader struct {
+	ctx context.Context //nolint:containedctx
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// canonicalSourceNames canonicalizes the referenced source file names for
+// --canonical-paths, removing the duplicates this reveals. With "clean" the
+// names are cleaned lexically, with "absolute" relative names are additionally
+// made absolute. It returns the canonical names and the original names of the
+// ones that changed.
+func canonicalSourceNames(names []string, mode string) ([]string, map[string]string, error) {
+	if mode == "none" {
+		return names, nil, nil
+	}
+
+	seen := make(map[string]struct{}, len(names))
+	canonical := make([]string, 0, len(names))
+	originals := map[string]string{}
+	for _, name := range names {
+		c := filepath.Clean(name)
+		if mode == "absolute" {
+			abs, err := filepath.Abs(c)
+			if err != nil {
+				return nil, nil, fmt.Errorf("make %q absolute: %w", name, err)
+			}
+			c = abs
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		canonical = append(canonical, c)
+		if c != name {
+			originals[c] = name
+		}
+	}
+	return canonical, originals, nil
+}
+
+// readSourcesManifest reads the source file names listed by the
+// --sources-manifest at path, either as a JSON array of strings or one name
+// per line. Empty lines and duplicate names are skipped.
+func readSourcesManifest(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read sources manifest: %w", err)
+	}
+
+	var list []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, fmt.Errorf("parse sources manifest %s: %w", path, err)
+		}
+	} else {
+		list = strings.Split(string(data), "\n")
+	}
+
+	seen := make(map[string]struct{}, len(list))
+	names := make([]string, 0, len(list))
+	for _, name := range list {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// dirSourceFileNames returns the files below dir whose path relative to dir
+// matches any of the include patterns, or all files if there are none. The
+// patterns are matched like path.Match, with ** additionally matching any
+// number of directories. Files and directories excluded by the ignore files
+// of their directory or the ones above are skipped.
+func dirSourceFileNames(ctx context.Context, dir string, include []string) ([]string, error) {
+	var (
+		names []string
+		rules ignoreRules
+	)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			base := rel
+			if rel == "." {
+				base = ""
+			} else if rules.ignored(rel, true) {
+				return filepath.SkipDir
+			}
+			dirRules, err := readIgnoreFile(filepath.Join(name, ignoreFileName), base)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, dirRules...)
+			return nil
+		}
+		if d.Name() == ignoreFileName || rules.ignored(rel, false) {
+			return nil
+		}
+
+		if len(include) > 0 && !slices.ContainsFunc(include, func(pattern string) bool { return matchGlob(pattern, rel) }) {
+			return nil
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk source directory: %w", err)
+	}
+	return names, nil
+}
+
+// matchGlob reports whether the slash-separated name matches pattern.
+func matchGlob(pattern, name string) bool {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// validateGlob checks that pattern is well-formed, as matchGlob treats
+// malformed patterns as not matching.
+func validateGlob(pattern string) error {
+	for _, part := range strings.Split(pattern, "/") {
+		if part == "**" {
+			continue
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func matchGlobParts(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Match the rest of the pattern against every suffix.
+			for i := range len(name) + 1 {
+				if matchGlobParts(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
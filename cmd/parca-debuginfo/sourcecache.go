@@ -0,0 +1,106 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// sourceCacheMinAge is how long ago a file must have been modified for its
+// hash to be cached. A change within the same timestamp granularity right
+// after hashing would otherwise go unnoticed.
+const sourceCacheMinAge = time.Second
+
+// sourceCache remembers the content hashes of source files across
+// invocations, keyed by path and validated by size and modification time, so
+// that unchanged files are not hashed again. Every path has its own entry file
+// that is replaced atomically, so that invocations sharing the cache never read
+// partially written entries.
+type sourceCache struct {
+	dir string
+}
+
+type sourceCacheEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	Hash    string `json:"hash"`
+}
+
+func openSourceCache(dir string) (*sourceCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:mnd
+		return nil, fmt.Errorf("create source cache: %w", err)
+	}
+	return &sourceCache{dir: dir}, nil
+}
+
+func (c *sourceCache) entryPath(path string) string {
+	return filepath.Join(c.dir, strconv.FormatUint(xxhash.Sum64String(path), 16)+".json")
+}
+
+// lookup returns the cached hash of the file at path, if it is unchanged
+// according to fi. Unreadable entries are treated as missing.
+func (c *sourceCache) lookup(path string, fi fs.FileInfo) (string, bool) {
+	data, err := os.ReadFile(c.entryPath(path))
+	if err != nil {
+		return "", false
+	}
+	var e sourceCacheEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return "", false
+	}
+	if e.Path != path || e.Size != fi.Size() || e.ModTime != fi.ModTime().UnixNano() || e.Hash == "" {
+		return "", false
+	}
+	return e.Hash, true
+}
+
+// store records the hash of the file at path as of fi.
+func (c *sourceCache) store(path string, fi fs.FileInfo, h string) error {
+	if time.Since(fi.ModTime()) < sourceCacheMinAge {
+		return nil
+	}
+	data, err := json.Marshal(sourceCacheEntry{Path: path, Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Hash: h})
+	if err != nil {
+		return fmt.Errorf("marshal source cache entry: %w", err)
+	}
+
+	f, err := os.CreateTemp(c.dir, ".entry-*")
+	if err != nil {
+		return fmt.Errorf("create source cache entry: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("write source cache entry: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("close source cache entry: %w", err)
+	}
+	if err := os.Rename(f.Name(), c.entryPath(path)); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("rename source cache entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rzajac/flexbuf"
+)
+
+// spillBuffer is an in-memory buffer that moves its contents to a temporary
+// file once it would grow beyond threshold bytes, so that extracting large
+// files does not need to hold them in memory. Close removes the file.
+type spillBuffer struct {
+	threshold int64
+
+	mem  *flexbuf.Buffer
+	file *os.File
+}
+
+// defaultSpillThreshold is the default of --spill-threshold, for the commands
+// that do not have the flag.
+const defaultSpillThreshold = 256 << 20
+
+func newSpillBuffer(threshold int64) *spillBuffer {
+	return &spillBuffer{threshold: threshold, mem: &flexbuf.Buffer{}}
+}
+
+// maybeSpill moves the buffer to disk if writing up to end exceeds the threshold.
+func (b *spillBuffer) maybeSpill(end int64) error {
+	if b.file != nil || end <= b.threshold {
+		return nil
+	}
+
+	f, err := os.CreateTemp("", "parca-debuginfo-*.debuginfo")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(b.mem, 0, int64(b.mem.Len()))); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("write temporary file: %w", err)
+	}
+	if _, err := f.Seek(int64(b.mem.Offset()), io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("seek temporary file: %w", err)
+	}
+	b.file = f
+	b.mem = nil
+	return nil
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil {
+		if err := b.maybeSpill(int64(b.mem.Offset() + len(p))); err != nil {
+			return 0, err
+		}
+	}
+	if b.file != nil {
+		return b.file.Write(p)
+	}
+	return b.mem.Write(p)
+}
+
+func (b *spillBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if err := b.maybeSpill(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	if b.file != nil {
+		return b.file.WriteAt(p, off)
+	}
+	return b.mem.WriteAt(p, off)
+}
+
+func (b *spillBuffer) Read(p []byte) (int, error) {
+	if b.file != nil {
+		return b.file.Read(p)
+	}
+	return b.mem.Read(p)
+}
+
+func (b *spillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if b.file != nil {
+		return b.file.ReadAt(p, off)
+	}
+	return b.mem.ReadAt(p, off)
+}
+
+func (b *spillBuffer) Seek(offset int64, whence int) (int64, error) {
+	if b.file != nil {
+		return b.file.Seek(offset, whence)
+	}
+	return b.mem.Seek(offset, whence)
+}
+
+// Size returns the size of the buffered data.
+func (b *spillBuffer) Size() (int64, error) {
+	if b.file == nil {
+		return int64(b.mem.Len()), nil
+	}
+	fi, err := b.file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat temporary file: %w", err)
+	}
+	return fi.Size(), nil
+}
+
+// Close releases the buffer and removes its temporary file, if any.
+func (b *spillBuffer) Close() error {
+	if b.file == nil {
+		b.mem = nil
+		return nil
+	}
+	err := b.file.Close()
+	if rerr := os.Remove(b.file.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
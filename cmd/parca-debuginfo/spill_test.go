@@ -0,0 +1,133 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	const threshold = 16
+	for _, tc := range []struct {
+		name string
+		// write writes to b and returns the contents it should hold.
+		write   func(t *testing.T, b *spillBuffer) []byte
+		spilled bool
+	}{
+		{
+			name: "below threshold",
+			write: func(t *testing.T, b *spillBuffer) []byte {
+				mustWrite(t, b, []byte("0123456789"))
+				return []byte("0123456789")
+			},
+		},
+		{
+			name: "at threshold",
+			write: func(t *testing.T, b *spillBuffer) []byte {
+				mustWrite(t, b, []byte("01234567"))
+				mustWrite(t, b, []byte("89abcdef"))
+				return []byte("0123456789abcdef")
+			},
+		},
+		{
+			name: "write beyond threshold",
+			write: func(t *testing.T, b *spillBuffer) []byte {
+				mustWrite(t, b, []byte("0123456789"))
+				mustWrite(t, b, []byte("abcdefghij"))
+				return []byte("0123456789abcdefghij")
+			},
+			spilled: true,
+		},
+		{
+			name: "write at beyond threshold",
+			write: func(t *testing.T, b *spillBuffer) []byte {
+				mustWrite(t, b, []byte("0123456789"))
+				if _, err := b.WriteAt([]byte("XY"), 18); err != nil {
+					t.Fatal(err)
+				}
+				// Writes continue at the offset before spilling.
+				mustWrite(t, b, []byte("ab"))
+				return []byte("0123456789ab\x00\x00\x00\x00\x00\x00XY")
+			},
+			spilled: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			t.Setenv("TMPDIR", dir)
+
+			b := newSpillBuffer(threshold)
+			want := tc.write(t, b)
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spilled := len(entries) == 1; spilled != tc.spilled || len(entries) > 1 {
+				t.Fatalf("got %d temporary files, want spilled: %v", len(entries), tc.spilled)
+			}
+
+			size, err := b.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != int64(len(want)) {
+				t.Errorf("Size() = %d, want %d", size, len(want))
+			}
+			for off := range want {
+				got := make([]byte, 4)
+				n, err := b.ReadAt(got, int64(off))
+				end := min(off+len(got), len(want))
+				if n != end-off || (end-off < len(got)) != (err == io.EOF) {
+					t.Errorf("ReadAt(%d) = %d, %v, want %d bytes", off, n, err, end-off)
+				}
+				if !bytes.Equal(got[:n], want[off:off+n]) {
+					t.Errorf("ReadAt(%d) read %q, want %q", off, got[:n], want[off:end])
+				}
+			}
+			if _, err := b.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("read %q, want %q", got, want)
+			}
+
+			if err := b.Close(); err != nil {
+				t.Fatal(err)
+			}
+			entries, err = os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("temporary file %s is left after Close", entries[0].Name())
+			}
+		})
+	}
+}
+
+func mustWrite(t *testing.T, b *spillBuffer, p []byte) {
+	t.Helper()
+	if n, err := b.Write(p); err != nil || n != len(p) {
+		t.Fatalf("Write(%q) = %d, %v", p, n, err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	debuginfopb "github.com/parca-dev/parca/gen/proto/go/parca/debuginfo/v1alpha1"
+)
+
+const (
+	uploadStatusPresent = "present"
+	uploadStatusAbsent  = "absent"
+	uploadStatusError   = "error"
+)
+
+// uploadStatus is whether a store already has a file, as reported by the
+// status command.
+type uploadStatus struct {
+	Path    string `json:"path"`
+	BuildID string `json:"build_id"`
+	Type    string `json:"type"`
+	Store   string `json:"store"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// uploadStatuses asks every store whether it wants each of the uploads. Stores
+// that want a file do not have it yet, the others report why not. Nothing is
+// uploaded. Failures to ask a store are reported as error status and returned.
+func uploadStatuses(ctx context.Context, clients []*storeClient, uploads []*uploadInfo) ([]uploadStatus, error) {
+	var (
+		statuses []uploadStatus
+		errs     []error
+	)
+	for _, upload := range uploads {
+		for _, c := range clients {
+			s := uploadStatus{
+				Path:    upload.path,
+				BuildID: upload.buildID,
+				Type:    debuginfoTypeName(upload.typ),
+				Store:   c.address,
+			}
+			resp, err := c.pick().debuginfoClient.ShouldInitiateUpload(ctx, &debuginfopb.ShouldInitiateUploadRequest{
+				BuildId: upload.buildID,
+				Type:    upload.typ,
+			})
+			switch {
+			case err != nil:
+				s.Status = uploadStatusError
+				s.Reason = err.Error()
+				errs = append(errs, fmt.Errorf("store %s: check %q with Build ID %q: %w", c.address, upload.path, upload.buildID, err))
+			case resp.GetShouldInitiateUpload():
+				s.Status = uploadStatusAbsent
+				s.Reason = resp.GetReason()
+			default:
+				s.Status = uploadStatusPresent
+				s.Reason = resp.GetReason()
+			}
+			statuses = append(statuses, s)
+		}
+	}
+	return statuses, errors.Join(errs...)
+}
+
+func printUploadStatuses(w io.Writer, statuses []uploadStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0) //nolint:mnd
+	fmt.Fprintln(tw, "PATH\tBUILD ID\tTYPE\tSTORE\tSTATUS\tREASON")
+	for _, s := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Path, s.BuildID, s.Type, s.Store, s.Status, s.Reason)
+	}
+	return tw.Flush()
+}
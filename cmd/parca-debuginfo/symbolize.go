@@ -0,0 +1,215 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxOriginDepth limits how many abstract origins and specifications are
+// followed to find the name of a function.
+const maxOriginDepth = 8
+
+// symbolizedAddress is what an address resolves to with the debug information
+// of a file.
+type symbolizedAddress struct {
+	Address  string `json:"address"`
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// parseAddress parses an address given in hex with 0x prefix, or in decimal.
+func parseAddress(s string) (uint64, error) {
+	pc, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q, expected e.g. 0x401000", s)
+	}
+	return pc, nil
+}
+
+// symbolize resolves the virtual address pc to the innermost function, inlined
+// ones included, and the source line it belongs to according to the DWARF
+// debug information of the ELF file at path. The function is looked up in the
+// symbol table if DWARF does not describe it, or if there is no DWARF at all.
+func symbolize(path string, pc uint64) (*symbolizedAddress, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open ELF file: %w", err)
+	}
+	defer f.Close()
+
+	res := &symbolizedAddress{Address: fmt.Sprintf("%#x", pc)}
+	if hasDWARFSections(f) {
+		if err := symbolizeDWARF(f, pc, res); err != nil {
+			return nil, err
+		}
+	}
+	if res.Function == "" {
+		res.Function = symbolName(f, pc)
+	}
+
+	if res.Function == "" && res.File == "" {
+		return nil, fmt.Errorf("address %#x is not covered by the debug information", pc)
+	}
+	return res, nil
+}
+
+// symbolizeDWARF sets the function and source line of pc in res, as far as
+// the DWARF debug information of f describes them.
+func symbolizeDWARF(f *elf.File, pc uint64, res *symbolizedAddress) error {
+	d, err := openDWARF(f)
+	if err != nil {
+		return fmt.Errorf("get dwarf data: %w", err)
+	}
+
+	r := d.Reader()
+	cu, err := r.SeekPC(pc)
+	switch {
+	case errors.Is(err, dwarf.ErrUnknownPC):
+		return nil
+	case err != nil:
+		return fmt.Errorf("look up compile unit of %#x: %w", pc, err)
+	}
+
+	lr, err := d.LineReader(cu)
+	if err != nil {
+		return fmt.Errorf("read line table: %w", err)
+	}
+	var le dwarf.LineEntry
+	if lr != nil && lr.SeekPC(pc, &le) == nil && le.File != nil {
+		res.File = le.File.Name
+		res.Line = le.Line
+		res.Column = le.Column
+	}
+
+	fn, err := innermostFunction(d, r, pc)
+	if err != nil {
+		return fmt.Errorf("look up function of %#x: %w", pc, err)
+	}
+	if fn != nil {
+		res.Function = functionName(d, fn, 0)
+	}
+	return nil
+}
+
+// innermostFunction returns the innermost subprogram or inlined subroutine
+// containing pc among the entries of the compile unit r is positioned in.
+func innermostFunction(d *dwarfData, r *dwarf.Reader, pc uint64) (*dwarf.Entry, error) {
+	var fn *dwarf.Entry
+	for depth := 1; depth > 0; {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if e.Tag == 0 {
+			depth--
+			continue
+		}
+		if e.Tag == dwarf.TagSubprogram || e.Tag == dwarf.TagInlinedSubroutine {
+			ranges, err := d.Ranges(e)
+			if err != nil {
+				return nil, err
+			}
+			if !containsPC(ranges, pc) {
+				r.SkipChildren()
+				continue
+			}
+			fn = e
+		}
+		if e.Children {
+			depth++
+		}
+	}
+	return fn, nil
+}
+
+func containsPC(ranges [][2]uint64, pc uint64) bool {
+	for _, r := range ranges {
+		if r[0] <= pc && pc < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// functionName returns the name of a function entry, following its abstract
+// origin or specification if it has none itself, as inlined and out-of-line
+// instances of functions do.
+func functionName(d *dwarfData, e *dwarf.Entry, depth int) string {
+	if name, ok := e.Val(dwarf.AttrName).(string); ok {
+		return name
+	}
+	if name, ok := e.Val(dwarf.AttrLinkageName).(string); ok {
+		return name
+	}
+	if depth >= maxOriginDepth {
+		return ""
+	}
+	for _, attr := range []dwarf.Attr{dwarf.AttrAbstractOrigin, dwarf.AttrSpecification} {
+		off, ok := e.Val(attr).(dwarf.Offset)
+		if !ok {
+			continue
+		}
+		r := d.Reader()
+		r.Seek(off)
+		origin, err := r.Next()
+		if err != nil || origin == nil {
+			continue
+		}
+		if name := functionName(d, origin, depth+1); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// symbolName returns the name of the function symbol containing pc, if any.
+func symbolName(f *elf.File, pc uint64) string {
+	syms, err := f.Symbols()
+	if err != nil {
+		return ""
+	}
+	for _, s := range syms {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value <= pc && pc < s.Value+s.Size {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+func (s *symbolizedAddress) print(w io.Writer) error {
+	function, location := s.Function, "??:0"
+	if function == "" {
+		function = "??"
+	}
+	if s.File != "" {
+		location = fmt.Sprintf("%s:%d", s.File, s.Line)
+		if s.Column > 0 {
+			location += fmt.Sprintf(":%d", s.Column)
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s at %s\n", function, location)
+	return err
+}
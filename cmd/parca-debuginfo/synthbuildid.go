@@ -0,0 +1,107 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/sha1" //nolint:gosec
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-kit/log"
+	"github.com/parca-dev/parca-agent/reporter/elfwriter"
+)
+
+// ntGNUBuildID is the type of GNU Build ID notes.
+const ntGNUBuildID = 3
+
+// synthesizeBuildID returns a Build ID for an ELF file without a Build ID
+// note: the SHA-1 of its .text section, so that every copy of the binary gets
+// the same one.
+func synthesizeBuildID(f *elf.File) (string, error) {
+	s := f.Section(".text")
+	if s == nil || s.Type == elf.SHT_NOBITS {
+		return "", fmt.Errorf("%w: no .text section to synthesize one from", ErrNoBuildID)
+	}
+	h := sha1.New() //nolint:gosec
+	if _, err := io.Copy(h, s.Open()); err != nil {
+		return "", fmt.Errorf("read .text section: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getExtractBuildID returns the Build ID of f like getELFBuildID. With
+// --synthesize-build-id, a Build ID is synthesized for files without a GNU
+// Build ID note and additionally returned as synthesized, to be added to the
+// debug information extracted from f. Go build IDs are never synthesized.
+func getExtractBuildID(f *elf.File, from string, ef extractFlags) (string, string, error) {
+	buildID, err := getELFBuildID(f, from)
+	if !ef.SynthesizeBuildID || from == "go" || !errors.Is(err, ErrNoBuildID) {
+		return buildID, "", err
+	}
+	buildID, err = synthesizeBuildID(f)
+	if err != nil {
+		return "", "", err
+	}
+	return buildID, buildID, nil
+}
+
+// extractDebugInfo writes the debug information of src to dst like
+// onlyKeepDebug. If synthesizedBuildID is set, a .note.gnu.build-id section
+// holding it is added to the output, as src has none. The output of
+// onlyKeepDebug is then buffered in a spill buffer with the given threshold
+// first.
+func extractDebugInfo(logger log.Logger, dst io.WriteSeeker, src elfwriter.ReadAtCloser, ef extractFlags, synthesizedBuildID string, spillThreshold int64) error {
+	if synthesizedBuildID == "" {
+		return onlyKeepDebug(logger, dst, src, ef)
+	}
+
+	buf := newSpillBuffer(spillThreshold)
+	defer buf.Close()
+	if err := onlyKeepDebug(logger, buf, src, ef); err != nil {
+		return err
+	}
+	size, err := buf.Size()
+	if err != nil {
+		return err
+	}
+	desc, err := hex.DecodeString(synthesizedBuildID)
+	if err != nil {
+		return fmt.Errorf("decode synthesized Build ID: %w", err)
+	}
+	e, err := newELFEditor(buf, size)
+	if err != nil {
+		return err
+	}
+	e.add(".note.gnu.build-id", elf.SHT_NOTE, 0, 4, buildIDNote(desc, e.f.ByteOrder)) //nolint:mnd
+	return e.writeTo(dst)
+}
+
+// buildIDNote returns the contents of a .note.gnu.build-id section holding
+// the Build ID desc: the note header, the NUL terminated owner GNU and the
+// Build ID, padded to a multiple of 4 bytes.
+func buildIDNote(desc []byte, order binary.ByteOrder) []byte {
+	const owner = "GNU\x00"
+	data := make([]byte, 12+len(owner)+(len(desc)+3)&^3) //nolint:mnd
+	order.PutUint32(data[0:], uint32(len(owner)))
+	order.PutUint32(data[4:], uint32(len(desc))) //nolint:gosec
+	order.PutUint32(data[8:], ntGNUBuildID)
+	copy(data[12:], owner)
+	copy(data[12+len(owner):], desc)
+	return data
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// uploadManifest records what an upload run uploaded, written with
+// --write-upload-manifest, so that the same files can be uploaded again with
+// --from-manifest.
+type uploadManifest struct {
+	CreatedAt time.Time             `json:"created_at"`
+	Files     []uploadManifestEntry `json:"files"`
+}
+
+type uploadManifestEntry struct {
+	// Path is the file as passed to upload, also for the architectures of
+	// multi-architecture files, which additionally have Arch set.
+	Path    string `json:"path"`
+	Arch    string `json:"arch,omitempty"`
+	Type    string `json:"type"`
+	BuildID string `json:"build_id"`
+	// BuildIDFromFlag is set if the Build ID was given by --build-id
+	// instead of read from the file.
+	BuildIDFromFlag bool      `json:"build_id_from_flag,omitempty"`
+	Hash            string    `json:"hash,omitempty"`
+	Size            int64     `json:"size"`
+	Uploaded        int       `json:"uploaded"`
+	FinishedAt      time.Time `json:"finished_at"`
+}
+
+// writeUploadManifest records the uploads that finished to path.
+func writeUploadManifest(path string, flags flags, uploads []*uploadInfo) error {
+	m := uploadManifest{CreatedAt: time.Now().UTC(), Files: []uploadManifestEntry{}}
+	for _, u := range uploads {
+		if u.finishedAt.IsZero() {
+			continue
+		}
+		e := uploadManifestEntry{
+			Path:            u.path,
+			Type:            debuginfoTypeName(u.typ),
+			BuildID:         u.buildID,
+			BuildIDFromFlag: flags.Upload.BuildID != "",
+			Hash:            u.contentHash,
+			Size:            u.size,
+			Uploaded:        u.uploaded,
+			FinishedAt:      u.finishedAt.UTC(),
+		}
+		if u.slice != nil {
+			e.Path = u.slice.path
+			e.Arch = u.slice.arch
+		}
+		m.Files = append(m.Files, e)
+	}
+
+	tmps := &tempFiles{}
+	if err := tmps.writeFile(path, func(f *os.File) error {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	}); err != nil {
+		return fmt.Errorf("write upload manifest: %w", err)
+	}
+	return nil
+}
+
+// manifestTarget is a file to upload again from an upload manifest, with the
+// entries recorded for it.
+type manifestTarget struct {
+	path    string
+	typ     string
+	entries []uploadManifestEntry
+}
+
+// readUploadManifest reads the files to upload again from the manifest at
+// path, grouping the architectures of multi-architecture files.
+func readUploadManifest(path string) ([]manifestTarget, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read upload manifest: %w", err)
+	}
+	var m uploadManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parse upload manifest %q: %w", path, err)
+	}
+
+	var targets []manifestTarget
+	index := map[[2]string]int{}
+	for _, e := range m.Files {
+		if !slices.Contains(uploadTypeNames, e.Type) || e.Type == "auto" {
+			return nil, fmt.Errorf("upload manifest %q: invalid type %q of %q", path, e.Type, e.Path)
+		}
+		key := [2]string{e.Path, e.Type}
+		i, ok := index[key]
+		if !ok {
+			i = len(targets)
+			index[key] = i
+			targets = append(targets, manifestTarget{path: e.Path, typ: e.Type})
+		}
+		targets[i].entries = append(targets[i].entries, e)
+	}
+	return targets, nil
+}
+
+// matchManifestEntries returns the uploads resolved for t that its manifest
+// entries recorded, failing if the file no longer has a recorded Build ID.
+func matchManifestEntries(t manifestTarget, uploads []*uploadInfo) ([]*uploadInfo, error) {
+	matched := make([]*uploadInfo, 0, len(t.entries))
+	for _, e := range t.entries {
+		i := slices.IndexFunc(uploads, func(u *uploadInfo) bool {
+			if e.Arch != "" && (u.slice == nil || u.slice.arch != e.Arch) {
+				return false
+			}
+			return u.buildID == e.BuildID
+		})
+		if i < 0 {
+			name := t.path
+			if e.Arch != "" {
+				name += " (" + e.Arch + ")"
+			}
+			return nil, fmt.Errorf("%q no longer has the Build ID %q recorded in the upload manifest", name, e.BuildID)
+		}
+		matched = append(matched, uploads[i])
+	}
+	return matched, nil
+}
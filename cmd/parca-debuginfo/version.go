@@ -0,0 +1,80 @@
+// Copyright (c) 2022 The Parca Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set via ldflags at release time, see .goreleaser.yml.
+var (
+	version string
+	commit  string
+	date    string
+	goArch  string
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+	GoArch    string `json:"go_arch"`
+}
+
+// getBuildInfo returns the build information of the running binary. Values set
+// via ldflags take precedence over the ones embedded by the Go toolchain.
+func getBuildInfo() buildInfo {
+	bi := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      date,
+		GoVersion: runtime.Version(),
+		GoArch:    goArch,
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if bi.Version == "" && info.Main.Version != "(devel)" {
+			bi.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if bi.Commit == "" {
+					bi.Commit = s.Value
+				}
+			case "vcs.time":
+				if bi.Date == "" {
+					bi.Date = s.Value
+				}
+			}
+		}
+	}
+
+	if bi.Version == "" {
+		bi.Version = "dev"
+	}
+	if bi.GoArch == "" {
+		bi.GoArch = runtime.GOARCH
+	}
+
+	return bi
+}
+
+func (bi buildInfo) String() string {
+	return fmt.Sprintf("parca-debuginfo, version %s (commit: %s, date: %s, go: %s, arch: %s)", bi.Version, bi.Commit, bi.Date, bi.GoVersion, bi.GoArch)
+}